@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/soapboxsys/ombudslib/ombwire"
+)
+
+// publish stores bltn, the mirror of tweet, in the public record. If the tweet
+// was already archived, by us or by anyone else, nothing is published and the
+// existing record is returned instead, flagged as a duplicate.
+//
+// Jobs with different keys can still share a target, so publishing is
+// serialized per tweet here rather than by the work queue.
+func (s *server) publish(tweet *Tweet, bltn *ombwire.Bulletin) (*archiveRecord, bool, error) {
+	unlock := s.publishing.lock(tweet.IdString())
+	defer unlock()
+
+	rec, err := s.store.archived(tweet.IdString())
+	if err != nil {
+		return nil, false, err
+	}
+	if rec != nil {
+		log.Printf("Info: Tweet %s was already stored in bltn: %s\n", rec.TweetId, rec.Txid)
+		return rec, true, nil
+	}
+
+	if s.pubRecord != nil {
+		existing, err := s.pubRecord.findMirror(tweet.IdString())
+		if err != nil {
+			log.Printf("Failed: searching the public record: %s\n", err)
+		} else if existing != nil {
+			log.Printf("Info: Tweet %s is already in the public record as bltn: %s\n",
+				tweet.IdString(), existing.Txid)
+			rec = &archiveRecord{
+				TweetId:  tweet.IdString(),
+				Txid:     existing.Txid,
+				BltnHash: messageHash(existing.Message),
+				Time:     time.Now(),
+			}
+			if err := s.store.putArchived(rec); err != nil {
+				log.Printf("Failed: recording bltn of %s: %s\n", rec.TweetId, err)
+			}
+			return rec, true, nil
+		}
+	}
+
+	// A used up budget delays the job rather than failing it.
+	s.limits.await(endpointPublish)
+
+	txid, err := s.sink.publishBltn(bltn)
+	if err != nil {
+		return nil, false, err
+	}
+	log.Printf("Success: Stored bltn: %s", txid)
+
+	rec = &archiveRecord{
+		TweetId:  tweet.IdString(),
+		Txid:     txid,
+		BltnHash: messageHash(bltn.GetMessage()),
+		Time:     time.Now(),
+	}
+	if err := s.store.putArchived(rec); err != nil {
+		log.Printf("Failed: recording bltn of %s: %s\n", rec.TweetId, err)
+	}
+	return rec, false, nil
+}
+
+// keyedMutex is a set of mutexes, one for each key in use. The zero value is
+// ready to use.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	// The number of callers holding or waiting for the lock.
+	refs int
+}
+
+// lock locks the mutex for key and returns the function that unlocks it.
+func (km *keyedMutex) lock(key string) func() {
+	km.mu.Lock()
+	if km.locks == nil {
+		km.locks = make(map[string]*keyedLock)
+	}
+	l, ok := km.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		km.locks[key] = l
+	}
+	l.refs++
+	km.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		km.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(km.locks, key)
+		}
+		km.mu.Unlock()
+	}
+}
+
+// messageHash fingerprints the message of a bltn.
+func messageHash(msg string) string {
+	sum := sha256.Sum256([]byte(msg))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// maxBackfillPages bounds how far back a backfill or a poll pages through the
+// mentions timeline. Twitter only serves the last 800 mentions anyway.
+var maxBackfillPages = 8
+
+// recentIds remembers the ids of the last few tweets that went through the
+// pipeline so a tweet delivered twice, by a stream and by a backfill, is only
+// handled once.
+type recentIds struct {
+	ids  map[int64]bool
+	ring []int64
+	next int
+}
+
+func newRecentIds(size int) *recentIds {
+	return &recentIds{
+		ids:  make(map[int64]bool),
+		ring: make([]int64, size),
+	}
+}
+
+// add records id, reporting false if it was already seen.
+func (r *recentIds) add(id int64) bool {
+	if r.ids[id] {
+		return false
+	}
+	delete(r.ids, r.ring[r.next])
+	r.ring[r.next] = id
+	r.next = (r.next + 1) % len(r.ring)
+	r.ids[id] = true
+	return true
+}
+
+// markProcessed persists the id of tweet if it is the highest seen so far so
+// that mentions missed while the bot was down can be found later. While a
+// backfill is running the mark is only kept in memory, as the backfill has yet
+// to deliver the mentions below it, and it is persisted once every backfill
+// has finished.
+func (s *server) markProcessed(tweet *Tweet) {
+	if s.cfg.Replay != "" {
+		return
+	}
+	if tweet.Id > s.lastSeenId {
+		s.lastSeenId = tweet.Id
+	}
+	if atomic.LoadInt32(&s.backfilling) > 0 || s.lastSeenId == s.storedSeenId {
+		return
+	}
+	if err := s.lastSeen.store(strconv.FormatInt(s.lastSeenId, 10)); err != nil {
+		log.Printf("Failed: storing last seen tweet: %s\n", err)
+		return
+	}
+	s.storedSeenId = s.lastSeenId
+}
+
+// startBackfill queues the mentions that were made while the bot was not
+// listening, in the order they were made. Streams call it every time they
+// (re)connect. The backfill runs in the background so the stream can be read
+// meanwhile, duplicates are removed by the pipeline.
+func (s *server) startBackfill(out chan<- *Tweet) {
+	s.backfills.Add(1)
+	atomic.AddInt32(&s.backfilling, 1)
+	go func() {
+		defer s.backfills.Done()
+		defer atomic.AddInt32(&s.backfilling, -1)
+
+		// Only one backfill pages through the timeline at a time.
+		s.backfillMu.Lock()
+		defer s.backfillMu.Unlock()
+
+		missed, err := s.missedMentions()
+		if err != nil {
+			log.Printf("Failed: backfilling mentions: %s\n", err)
+		}
+		if len(missed) > 0 {
+			log.Printf("Info: Backfilling %d missed mentions\n", len(missed))
+		}
+		for i := len(missed) - 1; i >= 0; i-- {
+			out <- missed[i]
+		}
+	}()
+}
+
+// missedMentions pages backwards through the mentions timeline until it
+// reaches the last tweet the bot processed. The mentions are returned newest
+// first.
+func (s *server) missedMentions() ([]*Tweet, error) {
+	sinceId, err := s.lastSeen.load()
+	if err != nil || sinceId == "" {
+		// Nothing was ever processed so there is nothing to catch up on.
+		return nil, err
+	}
+
+	missed, wait, err := s.mentionsSince(sinceId)
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	return missed, err
+}
+
+// mentionsSince pages backwards through the mentions timeline until it
+// reaches sinceId. The mentions are returned newest first, along with how long
+// to wait before asking for more if the rate limit has been used up.
+func (s *server) mentionsSince(sinceId string) ([]*Tweet, time.Duration, error) {
+	mentions := []*Tweet{}
+	maxId := ""
+	var wait time.Duration
+	for page := 0; page < maxBackfillPages; page++ {
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+
+		params := map[string]string{
+			"count":      "200",
+			"since_id":   sinceId,
+			"tweet_mode": "extended",
+		}
+		if maxId != "" {
+			params["max_id"] = maxId
+		}
+
+		tweets, w, err := s.getMentions(params)
+		wait = w
+		if err != nil {
+			return mentions, wait, err
+		}
+		if len(tweets) == 0 {
+			break
+		}
+
+		mentions = append(mentions, tweets...)
+		oldest := tweets[len(tweets)-1].Id
+		maxId = strconv.FormatInt(oldest-1, 10)
+	}
+	return mentions, wait, nil
+}
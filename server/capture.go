@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// captureFile records every raw line read off of a Twitter stream into a
+// directory of JSONL files. A new file is started once the current one grows
+// past maxSize bytes or has been open for longer than maxAge. A zero value for
+// either disables that rule. The files it produces can be fed back through the
+// bot with --replay.
+type captureFile struct {
+	dir     string
+	maxSize int64
+	maxAge  time.Duration
+
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+func newCaptureFile(dir string, maxSize int64, maxAge time.Duration) (*captureFile, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &captureFile{
+		dir:     dir,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+	}
+	return c, nil
+}
+
+// Write appends line to the current capture file exactly as it was read,
+// rotating first if needed. Lines are always terminated by a newline so that
+// a partial read does not run into the next line.
+func (c *captureFile) Write(line string) error {
+	if !strings.HasSuffix(line, "\n") {
+		line += "\n"
+	}
+
+	if c.f == nil || c.full(len(line)) {
+		err := c.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := c.f.WriteString(line)
+	c.size += int64(n)
+	return err
+}
+
+// full reports whether writing n more bytes requires a new file.
+func (c *captureFile) full(n int) bool {
+	if c.maxSize > 0 && c.size > 0 && c.size+int64(n) > c.maxSize {
+		return true
+	}
+	if c.maxAge > 0 && time.Since(c.opened) > c.maxAge {
+		return true
+	}
+	return false
+}
+
+// rotate closes the current capture file and opens a fresh one named after
+// the time it was started.
+func (c *captureFile) rotate() error {
+	if err := c.Close(); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	name := fmt.Sprintf("stream-%s.jsonl", now.Format("20060102T150405.000"))
+	f, err := os.OpenFile(filepath.Join(c.dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	c.f = f
+	c.size = 0
+	c.opened = now
+	return nil
+}
+
+func (c *captureFile) Close() error {
+	if c.f == nil {
+		return nil
+	}
+	err := c.f.Close()
+	c.f = nil
+	return err
+}
@@ -10,6 +10,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/btcsuite/btcd/btcjson"
 	"github.com/btcsuite/btcd/chaincfg"
@@ -33,7 +34,49 @@ var (
 	defaultRPCCertFile    = filepath.Join(ombudsNodeHome, "rpc.cert")
 	defaultWalletCertFile = filepath.Join(ombudsNodeHome, "rpc.cert")
 	defaultAccessToken    = filepath.Join(retweeterHomeDir, "token.json")
+	defaultDBFile         = filepath.Join(retweeterHomeDir, "retweeter.db")
 	defaultRelayUrl       = "http://relay.getombuds.org"
+	defaultReplaySpeed    = 1.0
+	defaultCaptureMaxSize = int64(64 * 1024 * 1024)
+	defaultCaptureAge     = 24 * time.Hour
+	defaultStallTimeout   = 90 * time.Second
+	defaultSource         = sourceFilter
+	defaultPollInterval   = time.Minute
+	defaultSinceIdFile    = filepath.Join(retweeterHomeDir, "mentions.sinceid")
+	defaultLastSeenFile   = filepath.Join(retweeterHomeDir, "lastseen.id")
+	defaultWebhookListen  = ":8090"
+	defaultWebhookPath    = "/webhooks/twitter"
+	defaultRetweets       = retweetsIgnore
+	defaultTrigger        = triggerBoth
+	defaultThreadDepth    = 10
+	defaultWorkers        = 4
+	defaultQueueSize      = 100
+	defaultOverflow       = overflowSpill
+	defaultUpdateBudget   = 24
+	defaultShowBudget     = 180
+	defaultPublishBudget  = 60
+	defaultBusyBudget     = 4
+)
+
+// The kinds of tweet sources the server can be configured to read from.
+const (
+	sourceFilter   = "filter"   // The v1.1 statuses/filter stream.
+	sourceV2       = "v2"       // The v2 filtered stream.
+	sourceMentions = "mentions" // Polling the mentions timeline.
+	sourceWebhook  = "webhook"  // Account Activity API webhook events.
+)
+
+// How retweets of a tweet asking to be archived are treated.
+const (
+	retweetsIgnore   = "ignore"   // Retweets are not requests.
+	retweetsOriginal = "original" // Retweets ask for the original to be archived.
+)
+
+// What a tweet needs to contain to ask the bot to archive something.
+const (
+	triggerBoth    = "mention+hashtag" // A mention of the bot and the hashtag.
+	triggerMention = "mention"         // Only a mention of the bot.
+	triggerHashtag = "hashtag"         // Only the hashtag.
 )
 
 // config defines the configuration options for retweeter.
@@ -48,13 +91,51 @@ type config struct {
 	NoTLS       bool   `long:"notls" description:"Disable TLS"`
 	TestNet3    bool   `long:"testnet" description:"Connect to testnet"`
 
-	BotScreenName    string `long:"botscreenname" description:"The Twitter handle of the bot."`
-	ConsumerKey      string `long:"consumerkey" description:"Twitter API consumer key"`
-	ConsumerSecret   string `long:"consumersecret" description:"Twitter API consumer secret"`
-	AccessTokenFile  string `long:"accesstoken" short:"t" description:"The name of the file the access token is stored in."`
-	Hashtag          string `long:"hashtag" short:"h" description:"The hashtag to track."`
-	WalletPassphrase string `long:"walletpassphrase" description:"The wallet's passphrase for sending."`
-	RelayUrl         string `long:"relayurl" description:"The url to link to in tweets"`
+	BotScreenName    string   `long:"botscreenname" description:"The Twitter handle of the bot."`
+	ConsumerKey      string   `long:"consumerkey" description:"Twitter API consumer key"`
+	ConsumerSecret   string   `long:"consumersecret" description:"Twitter API consumer secret"`
+	AccessTokenFile  string   `long:"accesstoken" short:"t" description:"The name of the file the access token is stored in."`
+	Hashtags         []string `long:"hashtag" short:"h" description:"A hashtag that asks the bot to archive a tweet. May be given more than once to add aliases."`
+	WalletPassphrase string   `long:"walletpassphrase" description:"The wallet's passphrase for sending."`
+	RelayUrl         string   `long:"relayurl" description:"The url to link to in tweets"`
+	DBFile           string   `long:"db" description:"The database that records archived tweets and what happened to them since."`
+	PubRecordFile    string   `long:"pubrecord" description:"The node's public record database, e.g. ~/.ombnode/data/mainnet/pubrecord.db. When set, tweets already stored by others are not published again"`
+	Trigger          string   `long:"trigger" choice:"mention+hashtag" choice:"mention" choice:"hashtag" description:"What a tweet must contain to be archived: a mention of the bot, the hashtag or both."`
+	Retweets         string   `long:"retweets" choice:"ignore" choice:"original" description:"Whether retweets of a request are ignored or archive the original tweet."`
+
+	Workers   int    `long:"workers" description:"The number of requests handled at the same time"`
+	QueueSize int    `long:"queuesize" description:"The most requests waiting for a worker before the overflow policy applies"`
+	Overflow  string `long:"overflow" choice:"dropnewest" choice:"dropoldest" choice:"spill" description:"What to do with requests once the queue is full: turn away the newest, turn away the oldest or spill them to disk"`
+
+	UpdateBudget  int `long:"updatebudget" description:"The most replies posted to Twitter every 15 minutes"`
+	ShowBudget    int `long:"showbudget" description:"The most tweets fetched from Twitter every 15 minutes"`
+	PublishBudget int `long:"publishbudget" description:"The most bltns published every 15 minutes"`
+	BusyBudget    int `long:"busybudget" description:"The most replies every 15 minutes that tell a requester the bot is too busy. They are only sent when the reply budget is not needed otherwise. 0 disables them"`
+
+	Threads       bool   `long:"threads" description:"Archive the whole conversation above a reply instead of just its parent"`
+	ThreadKeyword string `long:"threadkeyword" description:"A word, such as archivethread, that asks for the whole conversation to be archived. Disabled unless set"`
+	ThreadDepth   int    `long:"threaddepth" description:"The most tweets of a conversation to archive"`
+
+	Source      string   `long:"source" choice:"filter" choice:"v2" choice:"mentions" choice:"webhook" description:"Where tweets are read from: the v1.1 filter stream, the v2 filtered stream, by polling the bot's mentions or from Account Activity webhook events"`
+	BearerToken string   `long:"bearertoken" description:"Twitter app bearer token, needed for the v2 stream"`
+	StreamRules []string `long:"streamrule" description:"A v2 filtered stream rule. May be given more than once. Defaults to mentions of the bot with the hashtag"`
+
+	PollInterval time.Duration `long:"pollinterval" description:"How often to poll for mentions"`
+	SinceIdFile  string        `long:"sinceidfile" description:"The file the newest polled mention is stored in"`
+	LastSeenFile string        `long:"lastseenfile" description:"The file the newest processed tweet is stored in, used to backfill mentions missed while disconnected"`
+
+	WebhookListen string `long:"webhooklisten" description:"The address the Account Activity webhook listens on"`
+	WebhookPath   string `long:"webhookpath" description:"The path the Account Activity webhook is registered at"`
+
+	StallTimeout time.Duration `long:"stalltimeout" description:"Reconnect when the stream sends nothing for this long"`
+	StatsListen  string        `long:"statslisten" description:"Serve operator stats at /debug/vars on this address, e.g. localhost:8081"`
+
+	Replay      string  `long:"replay" description:"Feed a file of captured stream JSON through the bot in a dry run. Nothing is fetched, published or tweeted, the bltns and replies are logged instead"`
+	ReplaySpeed float64 `long:"replayspeed" description:"Replay speed relative to when the tweets were originally sent. 0 replays as fast as possible"`
+
+	CaptureDir     string        `long:"capturedir" description:"Write every raw line read from the stream to rotated JSONL files in this directory"`
+	CaptureMaxSize int64         `long:"capturemaxsize" description:"Start a new capture file after this many bytes. 0 disables"`
+	CaptureMaxAge  time.Duration `long:"capturemaxage" description:"Start a new capture file after this long. 0 disables"`
 }
 
 func hasField(name, s string) {
@@ -130,6 +211,27 @@ func loadConfig() (*config, []string, error) {
 		RPCCert:         defaultRPCCertFile,
 		AccessTokenFile: defaultAccessToken,
 		RelayUrl:        defaultRelayUrl,
+		DBFile:          defaultDBFile,
+		Retweets:        defaultRetweets,
+		Trigger:         defaultTrigger,
+		ThreadDepth:     defaultThreadDepth,
+		Workers:         defaultWorkers,
+		QueueSize:       defaultQueueSize,
+		Overflow:        defaultOverflow,
+		UpdateBudget:    defaultUpdateBudget,
+		ShowBudget:      defaultShowBudget,
+		PublishBudget:   defaultPublishBudget,
+		BusyBudget:      defaultBusyBudget,
+		StallTimeout:    defaultStallTimeout,
+		Source:          defaultSource,
+		PollInterval:    defaultPollInterval,
+		SinceIdFile:     defaultSinceIdFile,
+		LastSeenFile:    defaultLastSeenFile,
+		WebhookListen:   defaultWebhookListen,
+		WebhookPath:     defaultWebhookPath,
+		ReplaySpeed:     defaultReplaySpeed,
+		CaptureMaxSize:  defaultCaptureMaxSize,
+		CaptureMaxAge:   defaultCaptureAge,
 	}
 
 	// Create the home directory if it doesn't already exist.
@@ -186,17 +288,90 @@ func loadConfig() (*config, []string, error) {
 
 	// Handle environment variable expansion in the RPC certificate path.
 	cfg.RPCCert = cleanAndExpandPath(cfg.RPCCert)
+	cfg.DBFile = cleanAndExpandPath(cfg.DBFile)
+	cfg.SinceIdFile = cleanAndExpandPath(cfg.SinceIdFile)
+	cfg.LastSeenFile = cleanAndExpandPath(cfg.LastSeenFile)
+	if cfg.PubRecordFile != "" {
+		cfg.PubRecordFile = cleanAndExpandPath(cfg.PubRecordFile)
+	}
+	if cfg.Replay != "" {
+		cfg.Replay = cleanAndExpandPath(cfg.Replay)
+	}
+	if cfg.CaptureDir != "" {
+		cfg.CaptureDir = cleanAndExpandPath(cfg.CaptureDir)
+	}
+	if cfg.StallTimeout <= 0 {
+		err := fmt.Errorf("stalltimeout must be positive")
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, usageMessage)
+		return nil, nil, err
+	}
+	if cfg.Source == sourceMentions && cfg.PollInterval <= 0 {
+		err := fmt.Errorf("pollinterval must be positive")
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, usageMessage)
+		return nil, nil, err
+	}
+	if cfg.Workers < 1 {
+		err := fmt.Errorf("workers must be at least 1")
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, usageMessage)
+		return nil, nil, err
+	}
+	if cfg.QueueSize < 1 {
+		err := fmt.Errorf("queuesize must be at least 1")
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, usageMessage)
+		return nil, nil, err
+	}
+	if cfg.UpdateBudget < 1 || cfg.ShowBudget < 1 || cfg.PublishBudget < 1 {
+		err := fmt.Errorf("updatebudget, showbudget and publishbudget must be at least 1")
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, usageMessage)
+		return nil, nil, err
+	}
+	if cfg.BusyBudget < 0 {
+		err := fmt.Errorf("busybudget must not be negative")
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, usageMessage)
+		return nil, nil, err
+	}
+	if cfg.ThreadDepth < 1 {
+		err := fmt.Errorf("threaddepth must be at least 1")
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, usageMessage)
+		return nil, nil, err
+	}
+	if cfg.ReplaySpeed < 0 {
+		err := fmt.Errorf("replayspeed must not be negative")
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, usageMessage)
+		return nil, nil, err
+	}
 
 	// Add default port to RPC server based on --testnet and --wallet flags
 	// if needed.
 	cfg.RPCServer = normalizeAddress(cfg.RPCServer, cfg.TestNet3,
 		false, true)
 
-	hasField("hashtag", cfg.Hashtag)
+	hasField("hashtag", strings.Join(cfg.Hashtags, ""))
 	//hasField("sending address", cfg.SendAddress)
-	hasField("consumer key", cfg.ConsumerKey)
-	hasField("consumer secret", cfg.ConsumerSecret)
-	hasField("wallet passphrase", cfg.WalletPassphrase)
+	if cfg.Trigger != triggerHashtag {
+		hasField("bot screen name", cfg.BotScreenName)
+	}
+	// A replay is a dry run that never reaches Twitter or the wallet, so it
+	// does not need their secrets.
+	if cfg.Replay == "" {
+		hasField("consumer key", cfg.ConsumerKey)
+		hasField("consumer secret", cfg.ConsumerSecret)
+		hasField("wallet passphrase", cfg.WalletPassphrase)
+		if cfg.Source == sourceV2 {
+			hasField("bearer token", cfg.BearerToken)
+			if len(cfg.StreamRules) == 0 {
+				hasField("bot screen name", cfg.BotScreenName)
+			}
+		}
+	}
 
 	return &cfg, remainingArgs, nil
 }
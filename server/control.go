@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// streamMessage is the envelope around the control messages Twitter mixes
+// into its streams alongside statuses. At most one of the fields is set.
+// See: https://dev.twitter.com/streaming/overview/messages-types
+type streamMessage struct {
+	Delete         *deleteNotice     `json:"delete"`
+	Limit          *limitNotice      `json:"limit"`
+	Disconnect     *disconnectNotice `json:"disconnect"`
+	Warning        *stallWarning     `json:"warning"`
+	StatusWithheld *withheldNotice   `json:"status_withheld"`
+}
+
+// deleteNotice indicates that a status was deleted by its author.
+type deleteNotice struct {
+	Status struct {
+		Id     int64 `json:"id"`
+		UserId int64 `json:"user_id"`
+	} `json:"status"`
+}
+
+// limitNotice is sent when more tweets matched the stream than Twitter was
+// willing to deliver. Track is the total undelivered since the connection was
+// opened.
+type limitNotice struct {
+	Track int `json:"track"`
+}
+
+// disconnectNotice is sent right before Twitter closes the stream.
+type disconnectNotice struct {
+	Code       int    `json:"code"`
+	StreamName string `json:"stream_name"`
+	Reason     string `json:"reason"`
+}
+
+// stallWarning is sent when the client is falling behind reading the stream.
+// It requires the stream to be opened with stall_warnings=true.
+type stallWarning struct {
+	Code        string `json:"code"`
+	Message     string `json:"message"`
+	PercentFull int    `json:"percent_full"`
+}
+
+// withheldNotice indicates a status was withheld in some countries.
+type withheldNotice struct {
+	Id                  int64    `json:"id"`
+	UserId              int64    `json:"user_id"`
+	WithheldInCountries []string `json:"withheld_in_countries"`
+}
+
+// disconnectError is returned when Twitter tells us it is closing the stream.
+type disconnectError struct {
+	notice *disconnectNotice
+}
+
+func (e *disconnectError) Error() string {
+	return fmt.Sprintf("Twitter disconnected stream %s with code %d: %s",
+		e.notice.StreamName, e.notice.Code, e.notice.Reason)
+}
+
+// decodeStreamMessage determines if str is a control message and not a status.
+func decodeStreamMessage(str string) (*streamMessage, bool) {
+	msg := &streamMessage{}
+	err := json.Unmarshal([]byte(str), msg)
+	if err != nil {
+		return nil, false
+	}
+
+	isCtrl := msg.Delete != nil || msg.Limit != nil || msg.Disconnect != nil ||
+		msg.Warning != nil || msg.StatusWithheld != nil
+	return msg, isCtrl
+}
+
+// streamState tracks what control messages have told us about a single
+// connection to a stream.
+type streamState struct {
+	undelivered int // The last total seen in a limit notice.
+}
+
+// handleStreamMessage acts on a control message read from a stream. A
+// disconnectError is returned if the stream must be reconnected.
+func (s *server) handleStreamMessage(msg *streamMessage, st *streamState) error {
+	switch {
+	case msg.Disconnect != nil:
+		return &disconnectError{msg.Disconnect}
+
+	case msg.Limit != nil:
+		missed := msg.Limit.Track - st.undelivered
+		st.undelivered = msg.Limit.Track
+		log.Printf("Info: Twitter dropped %d tweets, %d since connecting\n",
+			missed, msg.Limit.Track)
+
+	case msg.Warning != nil:
+		log.Printf("Info: Stall warning %s: %s (%d%% full)\n",
+			msg.Warning.Code, msg.Warning.Message, msg.Warning.PercentFull)
+
+	case msg.Delete != nil:
+		id := msg.Delete.Status.Id
+		found, err := s.store.updateArchived(strconv.FormatInt(id, 10), func(rec *archiveRecord) {
+			now := time.Now()
+			rec.Deleted = &now
+		})
+		if err != nil {
+			log.Printf("Failed: recording deletion of %d: %s\n", id, err)
+		} else if found {
+			log.Printf("Info: Archived tweet %d was deleted by its author\n", id)
+		}
+
+	case msg.StatusWithheld != nil:
+		id := msg.StatusWithheld.Id
+		withheldIn := msg.StatusWithheld.WithheldInCountries
+		countries := strings.Join(withheldIn, ",")
+		found, err := s.store.updateArchived(strconv.FormatInt(id, 10), func(rec *archiveRecord) {
+			rec.WithheldIn = withheldIn
+		})
+		if err != nil {
+			log.Printf("Failed: recording withholding of %d: %s\n", id, err)
+		} else if found {
+			log.Printf("Info: Archived tweet %d was withheld in: %s\n", id, countries)
+		}
+	}
+	return nil
+}
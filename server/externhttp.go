@@ -1,37 +1,24 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"math/rand"
-	"strconv"
+	"strings"
 )
 
-// GetTweet queries twitter's api for the tweet specified by id
+// GetTweet queries twitter's api for the tweet specified by id. If the budget
+// for fetching tweets is used up, or Twitter says its rate limit is, it waits
+// for it to refill.
 func (s *server) getTweet(id string) (*Tweet, error) {
+	for {
+		s.limits.await(endpointShow)
 
-	url := fmt.Sprintf("https://api.twitter.com/1.1/statuses/show/%s.json", id)
-	response, err := s.consumer.Get(url, map[string]string{}, s.token)
-	if err != nil {
-		return nil, err
-	}
-
-	if response.StatusCode != 200 {
-		return nil, fmt.Errorf("Could not get tweet: %s", id)
-	}
-	b, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	tweet := &Tweet{}
-	if err = json.Unmarshal(b, tweet); err != nil {
-		return nil, err
+		tweet, err := s.sink.fetchTweet(id)
+		if _, ok := err.(*budgetError); !ok {
+			return tweet, err
+		}
 	}
-
-	return tweet, nil
 }
 
 var retweetFailed []string = []string{
@@ -48,16 +35,9 @@ var retweetFailed []string = []string{
 func (s *server) storeFailed(tweet *Tweet) error {
 	t := len(retweetFailed)
 	status := fmt.Sprintf("@%s %s", tweet.User.ScreenName, retweetFailed[rand.Intn(t)])
-	resp, err := s.consumer.Post(
-		"https://api.twitter.com/1.1/statuses/update.json",
-		map[string]string{
-			"status":                status,
-			"in_reply_to_status_id": strconv.Itoa(tweet.Id),
-		},
-		s.token,
-	)
+	err := s.reply(tweet, status)
 	if err != nil {
-		log.Printf("FAILED:\nReTweet:%s\nResp:%s\n", tweet, resp.Status)
+		log.Printf("FAILED:\nReTweet:%s\nErr:%s\n", tweet.IdString(), err)
 		return err
 	}
 	log.Println("Success: Retweeted the error")
@@ -66,27 +46,54 @@ func (s *server) storeFailed(tweet *Tweet) error {
 
 // Formulates a response to a single tweet and posts it to Twitter. This links to what is stored in
 // the block chain.
-func (s *server) respondWithStatus(tweet *Tweet, storedParent bool) error {
+func (s *server) respondWithStatus(tweet *Tweet, targets []*target) error {
 
-	s.cacheSentTweet(tweet)
+	status := fmt.Sprintf("@%s %s been sent to the public record. See the status here: %s",
+		tweet.User.ScreenName, describe(targets), s.cfg.RelayUrl)
 
-	status := fmt.Sprintf("@%s Your tweet has been sent to the public record. You can see its status here: %s",
-		tweet.User.ScreenName, s.cfg.RelayUrl)
-	if storedParent {
-		status = fmt.Sprintf("@%s the tweet you originally replied to has been sent to the public record. See its status here: %s", tweet.User.ScreenName, s.cfg.RelayUrl)
-	}
+	return s.reply(tweet, status)
+}
 
-	_, err := s.consumer.Post(
-		"https://api.twitter.com/1.1/statuses/update.json",
-		map[string]string{
-			"status":                status,
-			"in_reply_to_status_id": strconv.Itoa(tweet.Id),
-		},
-		s.token,
-	)
+// Informs the user that what they asked for was already in the public record,
+// linking to the bltn it was stored in.
+func (s *server) respondWithExisting(tweet *Tweet, targets []*target, txid string) error {
 
-	if err != nil {
+	status := fmt.Sprintf("@%s %s already been sent to the public record. See it here: %s",
+		tweet.User.ScreenName, describe(targets), s.bltnUrl(txid))
+
+	return s.reply(tweet, status)
+}
+
+// Informs the user that the bot is too busy to handle their request.
+func (s *server) respondTooBusy(tweet *Tweet) error {
+	status := fmt.Sprintf("@%s Too busy right now, please try again later.",
+		tweet.User.ScreenName)
+
+	return s.reply(tweet, status)
+}
+
+// Informs the user that the thread they asked for was stored, linking to the
+// bltn of its first tweet.
+func (s *server) respondWithThread(tweet *Tweet, length int, rootTxid string) error {
+
+	status := fmt.Sprintf("@%s the thread of %d tweets has been sent to the public record. See it here: %s",
+		tweet.User.ScreenName, length, s.bltnUrl(rootTxid))
+
+	return s.reply(tweet, status)
+}
+
+// bltnUrl links to a single bltn on the relay.
+func (s *server) bltnUrl(txid string) string {
+	return fmt.Sprintf("%s/api/bltn/%s", strings.TrimSuffix(s.cfg.RelayUrl, "/"), txid)
+}
+
+// reply posts status to Twitter in reply to tweet. It returns a budgetError
+// without posting anything if the budget for replies is used up, or if
+// Twitter refused the reply for its rate limit.
+func (s *server) reply(tweet *Tweet, status string) error {
+	if err := s.limits.take(endpointUpdate); err != nil {
 		return err
 	}
-	return nil
+
+	return s.sink.postReply(tweet, status)
 }
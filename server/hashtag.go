@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strings"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// normalizeTag puts a hashtag into the form hashtags are compared in: without
+// the leading #, Unicode NFKC normalised and case folded. This way tags that
+// only differ in case, width or composition, like ＃ＲｅｃｏｒｄＴｈｉｓＰｌｅａｓｅ, all
+// match.
+func normalizeTag(tag string) string {
+	tag = norm.NFKC.String(tag)
+	tag = strings.TrimPrefix(tag, "#")
+	return norm.NFKC.String(cases.Fold().String(tag))
+}
+
+// tagSet is the set of hashtags that ask the bot to archive a tweet.
+type tagSet struct {
+	tags  []string        // The tags as configured, minus the #.
+	index map[string]bool // The normalised tags.
+}
+
+func newTagSet(tags []string) *tagSet {
+	ts := &tagSet{index: make(map[string]bool)}
+	for _, tag := range tags {
+		n := normalizeTag(tag)
+		if n == "" || ts.index[n] {
+			continue
+		}
+		ts.index[n] = true
+		ts.tags = append(ts.tags, strings.TrimPrefix(norm.NFKC.String(tag), "#"))
+	}
+	return ts
+}
+
+// matches reports whether any of the hashtags is in the set.
+func (ts *tagSet) matches(hashtags []HashTag) bool {
+	for _, ht := range hashtags {
+		if ts.index[normalizeTag(ht.Text)] {
+			return true
+		}
+	}
+	return false
+}
+
+// track formats the set for the track parameter of the v1.1 stream, which
+// matches any of the comma separated phrases.
+func (ts *tagSet) track() string {
+	phrases := make([]string, len(ts.tags))
+	for i, tag := range ts.tags {
+		phrases[i] = "#" + tag
+	}
+	return strings.Join(phrases, ",")
+}
+
+// rule formats the set as a v2 filtered stream rule matching any of the tags.
+func (ts *tagSet) rule() string {
+	if len(ts.tags) == 1 {
+		return "#" + ts.tags[0]
+	}
+	return "(#" + strings.Join(ts.tags, " OR #") + ")"
+}
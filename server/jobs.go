@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// jobState is how far the bot got in handling a request. A job moves through
+// the states in the order they are declared, or to jobFailed.
+type jobState string
+
+const (
+	jobReceived      jobState = "received"       // The request was accepted.
+	jobParentFetched jobState = "parent_fetched" // What to archive was fetched.
+	jobPublished     jobState = "published"      // Every bltn was published.
+	jobReplied       jobState = "replied"        // The requester was told.
+	jobFailed        jobState = "failed"         // The request was given up on.
+)
+
+// job is a request to archive tweets as it is persisted in the store. Every
+// step that completes is written to disk before the next one starts, so a
+// restarted bot picks the job up where it left off instead of losing the
+// request or handling it twice.
+type job struct {
+	Request *Tweet    `json:"request"`
+	State   jobState  `json:"state"`
+	Updated time.Time `json:"updated"`
+
+	// Set once the parent was fetched. A thread is archived in place of
+	// the targets if one was asked for.
+	Targets []*target `json:"targets,omitempty"`
+	Thread  []*Tweet  `json:"thread,omitempty"`
+
+	// Set once published. Txid links to the bltn the reply points to and
+	// Existing is true if every target was already in the public record.
+	Txid     string `json:"txid,omitempty"`
+	Existing bool   `json:"existing,omitempty"`
+
+	// Set if fetching or publishing failed. The job fails once the requester was told.
+	Failure string `json:"failure,omitempty"`
+}
+
+func (j *job) id() string {
+	return j.Request.IdString()
+}
+
+// key identifies what the job archives as far as it is known from the request
+// alone. Jobs with the same key are run one at a time. A job can archive
+// other tweets too, which publish guards on its own.
+func (j *job) key() string {
+	req := j.Request
+	switch {
+	case req.RetweetedStatus != nil:
+		return req.RetweetedStatus.IdString()
+	case req.QuotedStatus != nil:
+		return req.QuotedStatus.IdString()
+	case req.QuotedStatusIdStr != "":
+		return req.QuotedStatusIdStr
+	}
+	if ids := linkedStatusIds(req); len(ids) > 0 {
+		return ids[0]
+	}
+	if req.ParentIdStr != "" {
+		return req.ParentIdStr
+	}
+	return req.IdString()
+}
+
+func (j *job) done() bool {
+	return j.State == jobReplied || j.State == jobFailed
+}
+
+// acceptJob queues tweet as a new job. It returns nil if the tweet was
+// accepted before, as the restart that resumed that job has handled it.
+func (s *server) acceptJob(tweet *Tweet) (*job, error) {
+	j := &job{
+		Request: tweet,
+		State:   jobReceived,
+		Updated: time.Now(),
+	}
+	added, err := s.store.addJob(j)
+	if err != nil || !added {
+		return nil, err
+	}
+	return j, nil
+}
+
+// resumeJobs hands the jobs that were interrupted the last time the bot
+// stopped to the workers, so they are finished alongside new requests.
+func (s *server) resumeJobs() {
+	jobs, err := s.store.unfinishedJobs()
+	if err != nil {
+		log.Printf("Failed: loading unfinished jobs: %s\n", err)
+		return
+	}
+	if len(jobs) > 0 {
+		log.Printf("Info: Resuming %d unfinished jobs\n", len(jobs))
+	}
+	for _, j := range jobs {
+		log.Printf("Info: Resuming job for tweet %s from %s\n", j.id(), j.State)
+		s.enqueue(j)
+	}
+}
+
+// runJob takes a job through the remaining steps of handling its request,
+// storing its progress after each of them. A job is published right away and
+// its reply, whether it succeeded or not, is left to the outbox so the worker
+// never waits on the budget for replies.
+func (s *server) runJob(j *job) {
+	for !j.done() {
+		if j.State == jobPublished || j.Failure != "" {
+			if wait := s.limits.wait(endpointUpdate); wait > 0 {
+				log.Printf("Info: Deferring reply to tweet %s for %s\n", j.id(), wait)
+			}
+			s.outbox.add(j)
+			return
+		}
+
+		var err error
+		switch j.State {
+		case jobReceived:
+			err = s.fetchJob(j)
+		case jobParentFetched:
+			err = s.publishJob(j)
+		default:
+			err = fmt.Errorf("unknown job state %s", j.State)
+			j.State = jobFailed
+		}
+		if err != nil {
+			log.Printf("Failed: job for tweet %s: %s\n", j.id(), err)
+		}
+		if !s.saveJob(j) {
+			return
+		}
+	}
+}
+
+// saveJob stores the progress of j, reporting whether that succeeded.
+func (s *server) saveJob(j *job) bool {
+	j.Updated = time.Now()
+	if err := s.store.putJob(j); err != nil {
+		log.Printf("Failed: storing job for tweet %s: %s\n", j.id(), err)
+		return false
+	}
+	return true
+}
+
+// fetchJob determines and fetches what the request asks to be archived.
+func (s *server) fetchJob(j *job) error {
+	targets, err := s.findTargets(j.Request)
+	if err != nil {
+		j.Failure = err.Error()
+		return fmt.Errorf("could not get target tweet: %s", err)
+	}
+
+	// Only a target that is itself a reply has a conversation above it.
+	j.Targets = targets
+	if len(targets) == 1 && targets[0].Tweet.ParentIdStr != "" && s.wantsThread(j.Request) {
+		j.Thread = s.fetchThread(targets[0].Tweet)
+	}
+	j.State = jobParentFetched
+	return nil
+}
+
+// publishJob stores the targets in the public record. Targets that were
+// published before the job was interrupted are found in the store and not
+// published again.
+func (s *server) publishJob(j *job) error {
+	var err error
+	if j.Thread != nil {
+		j.Txid, err = s.publishThread(j.Thread)
+	} else {
+		j.Txid, j.Existing, err = s.publishTargets(j.Request, j.Targets)
+	}
+	if err != nil {
+		j.Failure = err.Error()
+		return fmt.Errorf("sending the bltn: %s", err)
+	}
+	j.State = jobPublished
+	return nil
+}
+
+// replyJob tells the requester where to find what they asked for, or that
+// storing it failed. A budgetError leaves the job as it was so the reply can
+// be tried again.
+func (s *server) replyJob(j *job) error {
+	var err error
+	switch {
+	case j.Failure != "":
+		err = s.storeFailed(j.Request)
+	case j.Thread != nil:
+		err = s.respondWithThread(j.Request, len(j.Thread), j.Txid)
+	case j.Existing:
+		err = s.respondWithExisting(j.Request, j.Targets, j.Txid)
+	default:
+		err = s.respondWithStatus(j.Request, j.Targets)
+	}
+	if _, ok := err.(*budgetError); ok {
+		return err
+	}
+	if j.Failure != "" {
+		j.State = jobFailed
+		return err
+	}
+	if err != nil {
+		j.State = jobFailed
+		return fmt.Errorf("Retweet failed: %s", err)
+	}
+	log.Println("Success: Responded via Twitter")
+	j.State = jobReplied
+	return nil
+}
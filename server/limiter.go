@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateWindow is the window Twitter's rate limits are expressed over. Every
+// budget is a number of calls per window.
+var rateWindow = 15 * time.Minute
+
+// The endpoints the bot budgets its calls to.
+const (
+	endpointUpdate  = "statuses/update" // Replies posted to Twitter.
+	endpointShow    = "statuses/show"   // Tweets fetched from Twitter.
+	endpointPublish = "wallet/publish"  // Bltns published by the wallet.
+	endpointNotice  = "notices/busy"    // Too busy notices, also replies.
+
+	// Only limited by what Twitter tells us.
+	endpointMentions = "statuses/mentions_timeline"
+)
+
+// budgetError is returned when a call does not fit in the budget of its
+// endpoint.
+type budgetError struct {
+	endpoint string
+	wait     time.Duration
+}
+
+func (e *budgetError) Error() string {
+	return fmt.Sprintf("budget for %s used up for another %s", e.endpoint, e.wait)
+}
+
+// tokenBucket is the budget left for a single endpoint. Tokens refill at a
+// steady rate so that a full window's budget comes back over one window. An
+// endpoint without a budget of its own has a capacity of 0 and is only held
+// back by Twitter's rate limit headers.
+type tokenBucket struct {
+	Tokens  float64   `json:"tokens"`
+	Updated time.Time `json:"updated"`
+	// When Twitter said the endpoint can be called again.
+	Reset time.Time `json:"reset,omitempty"`
+
+	capacity float64
+}
+
+// refill adds the tokens that came back since the bucket was last updated.
+func (b *tokenBucket) refill(now time.Time) {
+	// Twitter hands back the whole budget when its window resets.
+	if !b.Reset.IsZero() && !now.Before(b.Reset) {
+		b.Reset = time.Time{}
+		b.Tokens = b.capacity
+	}
+
+	elapsed := now.Sub(b.Updated)
+	if elapsed > 0 {
+		b.Tokens += b.capacity * float64(elapsed) / float64(rateWindow)
+		if b.Tokens > b.capacity {
+			b.Tokens = b.capacity
+		}
+	}
+	b.Updated = now
+}
+
+// wait returns how long until the endpoint may be called again.
+func (b *tokenBucket) wait() time.Duration {
+	if b.Updated.Before(b.Reset) {
+		return b.Reset.Sub(b.Updated)
+	}
+	if b.capacity == 0 || b.Tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.Tokens) / b.capacity * float64(rateWindow))
+}
+
+// limiter keeps the bot within a budget of calls to each endpoint. The state
+// of every bucket is written to the store so that restarting the bot does
+// not hand it a fresh budget.
+type limiter struct {
+	// clock returns the current time and sleep waits. Tests can swap them
+	// out.
+	clock func() time.Time
+	sleep func(time.Duration)
+	store *store
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// newLimiter creates a limiter with the given budget per window for each
+// endpoint, picking up the state of the buckets from st if it was stored.
+func newLimiter(st *store, clock func() time.Time, budgets map[string]int) (*limiter, error) {
+	l := &limiter{
+		clock:   clock,
+		sleep:   time.Sleep,
+		store:   st,
+		buckets: make(map[string]*tokenBucket),
+	}
+
+	for endpoint, budget := range budgets {
+		b := &tokenBucket{
+			Tokens:   float64(budget),
+			Updated:  clock(),
+			capacity: float64(budget),
+		}
+		if st != nil {
+			if _, err := st.bucket(endpoint, b); err != nil {
+				return nil, err
+			}
+		}
+		l.buckets[endpoint] = b
+	}
+	return l, nil
+}
+
+// wait returns how long until a call to endpoint fits in its budget.
+func (l *limiter) wait(endpoint string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[endpoint]
+	if !ok {
+		return 0
+	}
+	b.refill(l.clock())
+	return b.wait()
+}
+
+// pause blocks until a call to endpoint fits in its budget, without spending
+// any of it.
+func (l *limiter) pause(endpoint string) {
+	for wait := l.wait(endpoint); wait > 0; wait = l.wait(endpoint) {
+		log.Printf("Info: Waiting %s for the budget for %s\n", wait, endpoint)
+		l.sleep(wait)
+	}
+}
+
+// await blocks until a call to endpoint fits in its budget and then spends
+// it.
+func (l *limiter) await(endpoint string) {
+	for {
+		l.pause(endpoint)
+		if l.take(endpoint) == nil {
+			return
+		}
+	}
+}
+
+// observe reads Twitter's rate limit headers off a response from endpoint.
+// The budget is cut down to what Twitter says is left of it and, if nothing
+// is left, the endpoint is not called again until the window resets.
+func (l *limiter) observe(endpoint string, h http.Header) {
+	remaining, err := strconv.Atoi(h.Get("x-rate-limit-remaining"))
+	if err != nil {
+		return
+	}
+	reset, err := strconv.ParseInt(h.Get("x-rate-limit-reset"), 10, 64)
+	if err != nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[endpoint]
+	if !ok {
+		b = &tokenBucket{}
+		l.buckets[endpoint] = b
+	}
+	b.refill(l.clock())
+
+	if b.capacity > 0 && float64(remaining) < b.Tokens {
+		b.Tokens = float64(remaining)
+	}
+	if remaining == 0 {
+		b.Reset = time.Unix(reset, 0)
+		log.Printf("Info: Rate limit for %s used up until %s\n", endpoint, b.Reset)
+	}
+	l.persist(endpoint, b)
+}
+
+// refused turns a response Twitter refused because the rate limit of endpoint
+// was hit into a budgetError, so the call can be made again once the limit
+// resets. Any other response gives nil. If Twitter did not say when the limit
+// resets the endpoint is held back for a whole window.
+func (l *limiter) refused(endpoint string, resp *http.Response) error {
+	if resp == nil {
+		return nil
+	}
+	switch {
+	case resp.StatusCode == 420, resp.StatusCode == 429:
+	case resp.Header.Get("x-rate-limit-remaining") == "0":
+	default:
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[endpoint]
+	if !ok {
+		b = &tokenBucket{}
+		l.buckets[endpoint] = b
+	}
+	b.refill(l.clock())
+	if b.wait() == 0 {
+		b.Reset = b.Updated.Add(rateWindow)
+		l.persist(endpoint, b)
+	}
+	log.Printf("Info: Twitter refused a call to %s, rate limited until %s\n", endpoint, b.Reset)
+	return &budgetError{endpoint, b.wait()}
+}
+
+// take spends a call to endpoint. It returns an error, and spends nothing, if
+// the budget is used up.
+func (l *limiter) take(endpoint string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[endpoint]
+	if !ok {
+		return nil
+	}
+	b.refill(l.clock())
+	if wait := b.wait(); wait > 0 {
+		return &budgetError{endpoint, wait}
+	}
+	if b.capacity > 0 {
+		b.Tokens--
+	}
+	l.persist(endpoint, b)
+	return nil
+}
+
+func (l *limiter) persist(endpoint string, b *tokenBucket) {
+	if l.store == nil {
+		return
+	}
+	if err := l.store.putBucket(endpoint, b); err != nil {
+		log.Printf("Failed: storing budget for %s: %s\n", endpoint, err)
+	}
+}
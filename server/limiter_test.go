@@ -0,0 +1,169 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock that only moves when told to, or when the limiter
+// sleeps on it.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Sleep(d time.Duration) { c.now = c.now.Add(d) }
+
+func newTestLimiter(t *testing.T, st *store, clock *fakeClock, budget int) *limiter {
+	l, err := newLimiter(st, clock.Now, map[string]int{endpointUpdate: budget})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.sleep = clock.Sleep
+	return l
+}
+
+// spend takes from the budget until it is used up and returns how many calls
+// fit in it.
+func spend(t *testing.T, l *limiter) int {
+	n := 0
+	for ; n < 1000; n++ {
+		err := l.take(endpointUpdate)
+		if err == nil {
+			continue
+		}
+		if _, ok := err.(*budgetError); !ok {
+			t.Fatalf("take failed with %v, want a budgetError", err)
+		}
+		return n
+	}
+	t.Fatal("budget never ran out")
+	return n
+}
+
+func TestLimiterSpendsWholeBudget(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1500000000, 0)}
+	l := newTestLimiter(t, nil, clock, 24)
+
+	if n := spend(t, l); n != 24 {
+		t.Fatalf("spent %d calls, want 24", n)
+	}
+	if err := l.take(endpointUpdate); err == nil {
+		t.Fatal("take succeeded with the budget used up")
+	}
+	if wait := l.wait(endpointUpdate); wait != rateWindow/24 {
+		t.Fatalf("wait is %s, want %s", wait, rateWindow/24)
+	}
+}
+
+func TestLimiterRefillsOverWindow(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1500000000, 0)}
+	l := newTestLimiter(t, nil, clock, 24)
+	spend(t, l)
+
+	// Half the window brings back half the budget.
+	clock.Sleep(rateWindow / 2)
+	if n := spend(t, l); n != 12 {
+		t.Fatalf("spent %d calls after 7.5 minutes, want 12", n)
+	}
+
+	// A whole window brings back all of it, but never more.
+	clock.Sleep(rateWindow)
+	if n := spend(t, l); n != 24 {
+		t.Fatalf("spent %d calls after 15 minutes, want 24", n)
+	}
+	clock.Sleep(2 * rateWindow)
+	if n := spend(t, l); n != 24 {
+		t.Fatalf("spent %d calls after 30 minutes, want 24", n)
+	}
+}
+
+func TestLimiterAwaitSleepsUntilRefill(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	clock := &fakeClock{now: start}
+	l := newTestLimiter(t, nil, clock, 24)
+	spend(t, l)
+
+	l.await(endpointUpdate)
+	if slept := clock.now.Sub(start); slept != rateWindow/24 {
+		t.Fatalf("await slept %s, want %s", slept, rateWindow/24)
+	}
+}
+
+func TestLimiterRefusedWaitsForReset(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	clock := &fakeClock{now: start}
+	l := newTestLimiter(t, nil, clock, 24)
+
+	resp := &http.Response{StatusCode: 429, Header: http.Header{}}
+	resp.Header.Set("x-rate-limit-remaining", "0")
+	resp.Header.Set("x-rate-limit-reset", "1500000300")
+	l.observe(endpointUpdate, resp.Header)
+	err := l.refused(endpointUpdate, resp)
+	if _, ok := err.(*budgetError); !ok {
+		t.Fatalf("refused gave %v, want a budgetError", err)
+	}
+
+	l.await(endpointUpdate)
+	if slept := clock.now.Sub(start); slept != 5*time.Minute {
+		t.Fatalf("await slept %s, want until the reset 5m0s later", slept)
+	}
+
+	// Without a reset the endpoint is held back for a window.
+	resp = &http.Response{StatusCode: 420, Header: http.Header{}}
+	if l.refused(endpointUpdate, resp) == nil {
+		t.Fatal("refused gave nil for a 420")
+	}
+	if wait := l.wait(endpointUpdate); wait != rateWindow {
+		t.Fatalf("wait is %s, want %s", wait, rateWindow)
+	}
+
+	if l.refused(endpointUpdate, &http.Response{StatusCode: 404, Header: http.Header{}}) != nil {
+		t.Fatal("refused gave a budgetError for a 404")
+	}
+}
+
+func TestLimiterRestoresBudgetFromStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "limiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "retweeter.db")
+
+	clock := &fakeClock{now: time.Unix(1500000000, 0)}
+	st, err := openStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newTestLimiter(t, st, clock, 24)
+	for i := 0; i < 20; i++ {
+		if err := l.take(endpointUpdate); err != nil {
+			t.Fatal(err)
+		}
+	}
+	st.Close()
+
+	// A restart picks up the budget where it was left.
+	st, err = openStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	l = newTestLimiter(t, st, clock, 24)
+	if n := spend(t, l); n != 4 {
+		t.Fatalf("spent %d calls after restarting, want 4", n)
+	}
+
+	// Time that passed while the bot was down still refills it.
+	clock.Sleep(rateWindow)
+	l = newTestLimiter(t, st, clock, 24)
+	if n := spend(t, l); n != 24 {
+		t.Fatalf("spent %d calls a window after restarting, want 24", n)
+	}
+}
@@ -1,15 +1,16 @@
 package main
 
 import (
-	"bufio"
-	"container/list"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
-	"math"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/btcsuite/btcd/btcjson"
@@ -20,30 +21,52 @@ import (
 	"github.com/soapboxsys/ombudslib/ombwire"
 )
 
-// Twitter's api rate limiting window
-var windowDur time.Duration = 15 * time.Minute
-
 // The active BitcoinNet the application is interfacing with
 var activeNet chaincfg.Params
 
 // A json representation of Twitter's 'statuses' as they are pushed out as JSON via
 // their endpoints
+// See: https://dev.twitter.com/overview/api/tweets
 type Tweet struct {
-	Text        string     `json:"text"`                                // The content of the tweet
-	Id          int        `json:"id"`                                  // Unique Id for the given tweet.
-	User        UserFields `json:"user"`                                // The user object for this tweet.
-	Ents        Entities   `json:"entities"`                            // Contains objects within the tweet
-	Retweeted   bool       `json:"retweeted"`                           // Flag to indicate if status is a retweet.
-	ParentId    int        `json:"in_reply_to_status_id",omitempty`     // A field that indicates if the tweet is a reply
-	ParentIdStr string     `json:"in_reply_to_status_id_str",omitempty` // A field that indicates if the tweet is a reply
+	Id                int64          `json:"id"`                                  // Unique Id for the given tweet.
+	IdStr             string         `json:"id_str"`                              // The Id as a string, safe from float64 rounding.
+	CreatedAt         string         `json:"created_at"`                          // When the tweet was created, in time.RubyDate format.
+	Text              string         `json:"text"`                                // The content of the tweet, truncated at 140 characters in compat mode.
+	FullText          string         `json:"full_text,omitempty"`                 // The untruncated content when requested with tweet_mode=extended.
+	Truncated         bool           `json:"truncated"`                           // Flag to indicate if Text was cut short.
+	ExtendedTweet     *ExtendedTweet `json:"extended_tweet,omitempty"`            // The untruncated content as pushed out by streams.
+	User              UserFields     `json:"user"`                                // The user object for this tweet.
+	Ents              Entities       `json:"entities"`                            // Contains objects within the tweet
+	Retweeted         bool           `json:"retweeted"`                           // Flag to indicate if the authenticating user retweeted the status.
+	RetweetedStatus   *Tweet         `json:"retweeted_status,omitempty"`          // The original tweet if this tweet is a retweet.
+	QuotedStatusIdStr string         `json:"quoted_status_id_str,omitempty"`      // The Id of the quoted tweet if this is a quote tweet.
+	QuotedStatus      *Tweet         `json:"quoted_status,omitempty"`             // The quoted tweet if this is a quote tweet.
+	ParentId          int64          `json:"in_reply_to_status_id,omitempty"`     // A field that indicates if the tweet is a reply
+	ParentIdStr       string         `json:"in_reply_to_status_id_str,omitempty"` // A field that indicates if the tweet is a reply
+	ParentScreenName  string         `json:"in_reply_to_screen_name,omitempty"`   // The author of the tweet replied to.
+	DisplayTextRange  []int          `json:"display_text_range,omitempty"`        // The part of FullText that is not leading mentions or trailing links.
+}
+
+// ExtendedTweet holds the untruncated content of tweets longer than 140
+// characters as they are pushed out by the streaming endpoints.
+type ExtendedTweet struct {
+	FullText         string   `json:"full_text"`          // The content of the tweet.
+	Ents             Entities `json:"entities"`           // Contains objects within the full text.
+	DisplayTextRange []int    `json:"display_text_range"` // The part of FullText that is displayed.
 }
 
 type UserFields struct {
+	Id         int64  `json:"id"`          // Unique Id for the user.
+	IdStr      string `json:"id_str"`      // The Id as a string.
 	ScreenName string `json:"screen_name"` // Users Twitter handle
+	Name       string `json:"name"`        // Users display name
 }
 
 type Entities struct {
-	HashTags []HashTag `json:"hashtags"` // The list of hashtags within the tweet
+	HashTags     []HashTag     `json:"hashtags"`      // The list of hashtags within the tweet
+	UserMentions []UserMention `json:"user_mentions"` // The users mentioned in the tweet
+	Urls         []UrlEntity   `json:"urls"`          // The links within the tweet
+	Media        []MediaEntity `json:"media"`         // Photos and videos attached to the tweet
 }
 
 type HashTag struct {
@@ -51,33 +74,117 @@ type HashTag struct {
 	Indices []int  `json:"indices"` // Opening and closing position of the hashtag.
 }
 
-func (s *server) detectTweet(str string) bool {
+type UserMention struct {
+	Id         int64  `json:"id"`          // Unique Id for the mentioned user.
+	IdStr      string `json:"id_str"`      // The Id as a string.
+	ScreenName string `json:"screen_name"` // The mentioned user's handle minus the @.
+	Name       string `json:"name"`        // The mentioned user's display name.
+	Indices    []int  `json:"indices"`     // Opening and closing position of the mention.
+}
+
+type UrlEntity struct {
+	Url         string `json:"url"`          // The t.co wrapped link as it appears in the text.
+	ExpandedUrl string `json:"expanded_url"` // The link as the user wrote it.
+	DisplayUrl  string `json:"display_url"`  // The link as it is displayed.
+	Indices     []int  `json:"indices"`      // Opening and closing position of the link.
+}
+
+type MediaEntity struct {
+	Id            int64  `json:"id"`              // Unique Id for the media.
+	IdStr         string `json:"id_str"`          // The Id as a string.
+	Type          string `json:"type"`            // One of photo, video or animated_gif.
+	MediaUrlHttps string `json:"media_url_https"` // Where the media itself is hosted.
+	Url           string `json:"url"`             // The t.co wrapped link as it appears in the text.
+	ExpandedUrl   string `json:"expanded_url"`    // The link to the media's page on twitter.com
+	Indices       []int  `json:"indices"`         // Opening and closing position of the link.
+}
+
+// IdString returns the tweet's Id in the form Twitter's api expects it.
+func (t *Tweet) IdString() string {
+	if t.IdStr != "" {
+		return t.IdStr
+	}
+	return strconv.FormatInt(t.Id, 10)
+}
+
+// Body returns the complete content of the tweet, whichever way Twitter
+// delivered it.
+func (t *Tweet) Body() string {
+	switch {
+	case t.FullText != "":
+		return t.FullText
+	case t.ExtendedTweet != nil:
+		return t.ExtendedTweet.FullText
+	}
+	return t.Text
+}
+
+// FullEntities returns the entities found in the complete content of the
+// tweet. Entities past the 140th character are only listed in the extended
+// tweet.
+func (t *Tweet) FullEntities() Entities {
+	if t.ExtendedTweet != nil {
+		return t.ExtendedTweet.Ents
+	}
+	return t.Ents
+}
+
+// Created parses the time the tweet was created.
+func (t *Tweet) Created() (time.Time, error) {
+	return time.Parse(time.RubyDate, t.CreatedAt)
+}
+
+// Url is the permanent link to the tweet on twitter.com
+func (t *Tweet) Url() string {
+	return fmt.Sprintf("https://twitter.com/%s/status/%s", t.User.ScreenName, t.IdString())
+}
+
+// decodeTweet parses a single line of JSON as pushed out by Twitter into a
+// Tweet.
+func decodeTweet(str string) (*Tweet, error) {
 	tweet := &Tweet{}
 	err := json.Unmarshal([]byte(str), tweet)
 	if err != nil {
-		return false
+		return nil, err
 	}
+	return tweet, nil
+}
 
+func (s *server) detectTweet(tweet *Tweet) bool {
 	// Ignore tweets from the bot itself.
-	if tweet.User.ScreenName == s.cfg.BotScreenName {
+	if strings.EqualFold(tweet.User.ScreenName, s.cfg.BotScreenName) {
 		return false
 	}
 
-	// Ignore tweets that do not have #RecordThisPlease
-	noPlease := true
-	for _, ht := range tweet.Ents.HashTags {
-		if strings.ToLower(ht.Text) == "recordthisplease" {
-			noPlease = false
+	// Retweets carry the hashtags of the tweet they retweet, so they are
+	// judged by the original.
+	subject := tweet
+	if tweet.RetweetedStatus != nil {
+		if s.cfg.Retweets == retweetsIgnore {
+			return false
 		}
+		subject = tweet.RetweetedStatus
 	}
+	ents := subject.FullEntities()
 
-	if noPlease {
+	// Look for #RecordThisPlease or one of its aliases
+	hasPlease := s.triggerTags.matches(ents.HashTags)
+
+	// Look for a mention of the bot
+	mentioned := false
+	for _, m := range ents.UserMentions {
+		if strings.EqualFold(m.ScreenName, s.cfg.BotScreenName) {
+			mentioned = true
+		}
+	}
+
+	if !hasPlease && s.cfg.Trigger != triggerMention {
 		log.Println("Failed: No please in tweet. Try again")
 		return false
 	}
 
-	// Ignore retweets as well.
-	if tweet.Retweeted {
+	if !mentioned && s.cfg.Trigger != triggerHashtag {
+		log.Println("Failed: Bot not mentioned in tweet")
 		return false
 	}
 
@@ -91,22 +198,105 @@ type server struct {
 	token     *oauth.AccessToken
 	consumer  *oauth.Consumer
 	// The number of tweets we tried to store
-	cnt        int
-	tweetCache *list.List // All tweets sent in the last 15 minutes.
+	cnt int64
+	// The budget of calls to Twitter and the wallet.
+	limits *limiter
+	// Where calls to Twitter and the wallet go.
+	sink sink
+	// Accepted requests waiting for a worker.
+	work    *workQueue
+	spillMu sync.Mutex
+	// Replies waiting for the budget for replies to refill.
+	outbox *outbox
+	// Where raw stream lines are recorded, nil if capturing is disabled.
+	capture *captureFile
+	// The bot's on disk state, including every tweet we have archived.
+	store *store
+	// Held while a tweet is being published, so it is published only once.
+	publishing keyedMutex
+	// Where a dry run keeps its state, removed when the server is closed.
+	dryRunDir string
+	// The node's public record, nil if it is not searched before publishing.
+	pubRecord *pubRecord
+	// The hashtags that ask for a tweet to be archived.
+	triggerTags *tagSet
+
+	// The highest tweet id the pipeline has processed, where it is
+	// persisted and the id last persisted there.
+	lastSeen     *idFile
+	lastSeenId   int64
+	storedSeenId int64
+	// The number of backfills that have not delivered every tweet yet.
+	backfilling int32
+	// Tweets that recently went through the pipeline.
+	seen       *recentIds
+	backfills  sync.WaitGroup
+	backfillMu sync.Mutex
 }
 
 func newServer(cfg *config) (*server, error) {
+	s := &server{
+		cfg:         cfg,
+		work:        newWorkQueue(cfg.QueueSize, cfg.Overflow),
+		outbox:      newOutbox(cfg.BusyBudget),
+		triggerTags: newTagSet(cfg.Hashtags),
+		lastSeen:    &idFile{path: cfg.LastSeenFile},
+		seen:        newRecentIds(4096),
+	}
 
-	b, err := ioutil.ReadFile(cfg.AccessTokenFile)
+	lastSeen, err := s.lastSeen.load()
 	if err != nil {
 		return nil, err
 	}
+	if lastSeen != "" {
+		s.lastSeenId, err = strconv.ParseInt(lastSeen, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		s.storedSeenId = s.lastSeenId
+	}
+
+	if cfg.PubRecordFile != "" {
+		s.pubRecord, err = openPubRecord(cfg.PubRecordFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.CaptureDir != "" {
+		s.capture, err = newCaptureFile(cfg.CaptureDir, cfg.CaptureMaxSize, cfg.CaptureMaxAge)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Replay != "" {
+		err = s.setupDryRun()
+	} else {
+		err = s.setupLive()
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// setupLive connects the server to the wallet and Twitter.
+func (s *server) setupLive() error {
+	cfg := s.cfg
+
+	b, err := ioutil.ReadFile(cfg.AccessTokenFile)
+	if err != nil {
+		return err
+	}
 
 	tok := &oauth.AccessToken{}
 
 	err = json.Unmarshal(b, tok)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	// Setup Twitter Oauth
@@ -120,20 +310,61 @@ func newServer(cfg *config) (*server, error) {
 		},
 	)
 
-	client := createRPCClient(cfg)
 	pubParams := ombpublish.NormalParams(&activeNet, cfg.WalletPassphrase)
 	pubParams.Verbose = false
 
-	s := &server{
-		cfg:        cfg,
-		rpcClient:  client,
-		pubParams:  &pubParams,
-		token:      tok,
-		consumer:   c,
-		tweetCache: list.New(),
+	s.rpcClient = createRPCClient(cfg)
+	s.pubParams = &pubParams
+	s.token = tok
+	s.consumer = c
+	s.sink = &liveSink{s}
+
+	s.store, err = openStore(cfg.DBFile)
+	if err != nil {
+		return err
 	}
 
-	return s, nil
+	s.limits, err = newLimiter(s.store, time.Now, map[string]int{
+		endpointUpdate:  cfg.UpdateBudget,
+		endpointShow:    cfg.ShowBudget,
+		endpointPublish: cfg.PublishBudget,
+		endpointNotice:  cfg.BusyBudget,
+	})
+	return err
+}
+
+// setupDryRun prepares the server to replay a capture without reaching the
+// wallet or Twitter, so it needs neither of their secrets. The replay keeps a
+// fresh store of its own in a temporary directory, so it neither sees nor
+// changes what the bot has done for real.
+func (s *server) setupDryRun() error {
+	s.sink = dryRunSink{}
+
+	dir, err := ioutil.TempDir("", "retweeter-replay")
+	if err != nil {
+		return err
+	}
+	s.dryRunDir = dir
+	log.Printf("Info: Dry run, keeping the replay's state in %s\n", dir)
+
+	s.store, err = openStore(filepath.Join(dir, "retweeter.db"))
+	if err != nil {
+		return err
+	}
+
+	s.limits, err = newLimiter(nil, time.Now, nil)
+	return err
+}
+
+// Close releases the files the server holds. The state of a dry run is thrown
+// away.
+func (s *server) Close() {
+	if s.store != nil {
+		s.store.Close()
+	}
+	if s.dryRunDir != "" {
+		os.RemoveAll(s.dryRunDir)
+	}
 }
 
 func createRPCClient(cfg *config) *btcrpcclient.Client {
@@ -164,184 +395,99 @@ func createRPCClient(cfg *config) *btcrpcclient.Client {
 	return client
 }
 
-func (s *server) Start() {
-	s.listenTwitterStream()
-}
-
-// tryToReconnect uses an exponential backoff to try and reconnect to Twitter's
-// status stream. It will try for around 3 days to connect before giving up
-// completely.
-func (s *server) tryToReconnect() (*bufio.Reader, error) {
-	for i := 0; i < 30; i++ {
-		response, err := s.consumer.Get(
-			//"https://stream.twitter.com/1.1/statuses/filter.json",
-			"https://userstream.twitter.com/1.1/user.json",
-			map[string]string{"track": s.cfg.Hashtag},
-			s.token)
-
-		if err != nil {
-			// Backoffs at 1 + 1*(1+.10)^i
-			t := int(1000 + 1000*math.Pow(1+0.10, float64(i)))
-			backoff := time.Duration(t) * time.Millisecond
-			log.Printf("Saw: %s. Backing off for: %s\n", err, backoff.String())
-			time.Sleep(backoff)
-			continue
-		}
-
-		reader := bufio.NewReader(response.Body)
-		log.Printf("Success: Reconnected to %s stream\n", s.cfg.Hashtag)
-		return reader, nil
+func (s *server) Start() error {
+	if s.cfg.StatsListen != "" {
+		go serveStats(s.cfg.StatsListen)
 	}
-	return nil, fmt.Errorf("Could not reconnect after retrying...")
-}
 
-func (s *server) listenTwitterStream() {
-	response, err := s.consumer.Get(
-		"https://stream.twitter.com/1.1/statuses/filter.json",
-		map[string]string{"track": s.cfg.Hashtag},
-		s.token)
+	watchQueue(s.work)
+	watchOutbox(s.outbox)
+	sent := s.startOutbox()
 
+	// Count the jobs left spilled by the last run so they are taken off disk
+	// and jobs for the same tweets queue up behind them.
+	spilled, err := s.store.spilledJobs()
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	for _, j := range spilled {
+		s.work.addSpilled(j.key(), 1)
 	}
-	defer response.Body.Close()
-
-	reader := bufio.NewReader(response.Body)
-	log.Printf("Connected to %s stream\n", s.cfg.Hashtag)
 
-	for {
-		str, err := reader.ReadString('\n')
-		if err != nil {
-			log.Printf("Reading from twitter threw %s\n", err)
-			reader, err = s.tryToReconnect()
-			if err != nil {
-				log.Fatal(err)
-			}
-			continue
-		}
-		if s.detectTweet(str) {
-			err := s.handleIncomingTweet(str)
-			if err != nil {
-				log.Println(err.Error())
-			}
-		}
+	if err := s.run(s.newSource()); err != nil {
+		return err
 	}
-}
 
-// holds meta data for the tweet cache.
-type cacheRecord struct {
-	ts    time.Time
-	tweet *Tweet
+	// Every request was published, wait for the deferred replies.
+	s.outbox.close()
+	sent.Wait()
+	return nil
 }
 
-func (s *server) cacheSentTweet(t *Tweet) {
-	if s.tweetCache.Len() >= 24 {
-		// Trim off the tweets that are older than the window.
-		cur := s.tweetCache.Back()
-		for cur.Next() != nil {
-			next := cur.Next()
-			curTweet := (cur.Value).(*cacheRecord)
-			if curTweet.ts.Add(windowDur).Before(time.Now()) {
-				// Current element is too old. Expire it.
-				s.tweetCache.Remove(cur)
-			}
-			cur = next
-		}
+// handleIncomingTweet accepts a decoded tweet as a job and queues it for the
+// workers, which produce the output in the blockchain and on twitter. Cases of
+// failing bulletins, failing tweets and unexpected scenarios are handled.
+func (s *server) handleIncomingTweet(tweet *Tweet) error {
+	log.Printf("Info: pushed tweet by @%s id:[%d]\n", tweet.User.ScreenName, tweet.Id)
+
+	j, err := s.acceptJob(tweet)
+	if err != nil {
+		log.Printf("Failed: could not queue tweet: %s\n", err)
+		return nil
 	}
-	r := cacheRecord{
-		ts:    time.Now(),
-		tweet: t,
+	if j == nil {
+		log.Printf("Info: Tweet %s was already accepted\n", tweet.IdString())
+		return nil
 	}
-
-	s.tweetCache.PushFront(&list.Element{Value: r})
+	s.enqueue(j)
+	return nil
 }
 
-// canSend ensures that no rate limits have been exceeded.
-func (s *server) canSend() bool {
-	if s.tweetCache.Len() < 24 {
-		// Cache is not full.
-		return true
-	}
-
-	// This is the last element in the list.
-	lastCacheR := s.tweetCache.Back().Value.(*cacheRecord)
-
-	window := lastCacheR.ts.Add(windowDur)
-	if time.Now().Before(window) {
-		// We have exceed the window's rate of messages. Do not tweet.
-		return false
+// publishTargets stores a bltn for each of the targets of req. It returns the
+// txid of the first and whether every target was already in the public record.
+func (s *server) publishTargets(req *Tweet, targets []*target) (string, bool, error) {
+	first := ""
+	allStored := true
+	for _, t := range targets {
+		wireBltn := s.makeBltn(t.Tweet, req, t.Kind)
+		rec, dup, err := s.publish(t.Tweet, wireBltn)
+		if err != nil {
+			return "", false, err
+		}
+		if first == "" {
+			first = rec.Txid
+		}
+		allStored = allStored && dup
 	}
-
-	return true
+	return first, allStored, nil
 }
 
-// handleIncomingTweet takes the raw json of a tweet and produces the output in the
-// blockchain and on twitter. Cases of failing bulletins, failing tweets and
-// unexpected scenarios are handled.
-func (s *server) handleIncomingTweet(str string) error {
-	//fmt.Printf("Here's the raw tweet: %s\n", str)
-	tweet := &Tweet{}
-	err := json.Unmarshal([]byte(str), tweet)
-	if err != nil {
-		return err
+func (s *server) makeBltn(tweet *Tweet, req *Tweet, kind targetKind) *ombwire.Bulletin {
+	// Bltns of quoted tweets end with who quoted them:
+	// Quoted by [@requester](https://twtr.com/requester/status/345345345343434)
+	msg := mirrorMsg(tweet)
+	if kind == targetQuote {
+		reqLink := fmt.Sprintf("[@%s](%s)", req.User.ScreenName, req.Url())
+		msg += fmt.Sprintf("\n\nQuoted by %s", reqLink)
 	}
-	log.Printf("Info: pushed tweet by @%s id:[%d]\n", tweet.User.ScreenName, tweet.Id)
-
-	if s.canSend() {
-		// Figure out if the tweet is a reply and if so, record what the
-		// original poster said. Use the in_reply_to_status field to determine
-		// if the server will respond to the original tweet or its parent.
-		// All responses via tweet are too the person that tweeted at the bot
-		// though.
-
-		// The tweet that we are going to backup
-		targetTweet := tweet
-		if tweet.ParentIdStr != "" {
-			targetTweet, err = s.getTweet(tweet.ParentIdStr)
-			if err != nil {
-				log.Printf("Failed: could not get parent tweet: %s", err)
-				return nil
-			}
-		}
-		storedParent := targetTweet.Id != tweet.Id
-
-		wireBltn := s.makeBltn(targetTweet)
-		txid, err := ombpublish.PublishBulletin(s.rpcClient, wireBltn, *s.pubParams)
-		if err != nil || txid == nil {
-			log.Printf("Failed: sending the bltn: %s\n", err)
-			s.storeFailed(tweet)
-			return nil
-		}
-		log.Printf("Success: Stored bltn: %s", txid)
 
-		err = s.respondWithStatus(tweet, storedParent)
-		if err != nil {
-			log.Printf("Failed: Retweet failed: %s\n", err)
-			return nil
-		}
-		log.Println("Success: Responded via Twitter")
+	now := uint64(time.Now().Unix())
+	bltn := ombwire.NewBulletin(msg, now, nil)
 
-	} else {
-		log.Println("Failed: Ignoring tweet by: @%s", tweet.User.ScreenName)
-	}
-	return nil
+	return bltn
 }
 
-func (s *server) makeBltn(tweet *Tweet) *ombwire.Bulletin {
+// mirrorMsg is the message every bltn of a tweet starts with.
+func mirrorMsg(tweet *Tweet) string {
 	sn := tweet.User.ScreenName
 
 	// Schema for bltns generated by this tool is:
 	// #RTMirror of [@username](https://twtr.com/uname/status/345345345343433)
 	// TWEET BODY TWEET BODY
 	// TWEET BODY TWEET BODY
-	postLink := fmt.Sprintf("[@%s](https://twitter.com/%s/status/%d)", sn, tweet.Id)
-
-	msg := fmt.Sprintf("#RTMirror of %s\n%s", postLink, tweet.Text)
+	postLink := fmt.Sprintf("[@%s](%s)", sn, tweet.Url())
 
-	now := uint64(time.Now().Unix())
-	bltn := ombwire.NewBulletin(msg, now, nil)
-
-	return bltn
+	return fmt.Sprintf("%s of %s\n%s", mirrorTag, postLink, tweet.Body())
 }
 
 func (s *server) makeUnlockCmd() interface{} {
@@ -361,6 +507,9 @@ func main() {
 		log.Fatal(err)
 	}
 
-	s.Start()
-
+	err = s.Start()
+	s.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+const mentionsUrl = "https://api.twitter.com/1.1/statuses/mentions_timeline.json"
+
+// mentionsPoller is a TweetSource that polls the bot's mentions timeline
+// instead of holding open a stream. It is meant for keys without streaming
+// access. The id of the newest mention seen is persisted so that a restart
+// picks up where the last run left off.
+type mentionsPoller struct {
+	s        *server
+	interval time.Duration
+	sinceId  *idFile
+}
+
+func newMentionsPoller(s *server) *mentionsPoller {
+	return &mentionsPoller{
+		s:        s,
+		interval: s.cfg.PollInterval,
+		sinceId:  &idFile{path: s.cfg.SinceIdFile},
+	}
+}
+
+func (mp *mentionsPoller) Run(out chan<- *Tweet) error {
+	sinceId, err := mp.sinceId.load()
+	if err != nil {
+		return err
+	}
+	log.Printf("Polling mentions every %s\n", mp.interval)
+
+	for {
+		tweets, wait, err := mp.poll(sinceId)
+		if err != nil {
+			// Mentions older than the pages fetched would be skipped,
+			// so the poll is tried again from the same since_id.
+			log.Printf("Failed: polling mentions: %s\n", err)
+			tweets = nil
+		}
+
+		// Without a since_id every recent mention would be archived
+		// again, so the first poll only marks where to start from.
+		if sinceId == "" && len(tweets) > 0 {
+			log.Println("Info: First poll of mentions, skipping the backlog")
+			sinceId = tweets[0].IdString()
+			tweets = nil
+		}
+
+		// The timeline is newest first.
+		for i := len(tweets) - 1; i >= 0; i-- {
+			out <- tweets[i]
+			sinceId = tweets[i].IdString()
+		}
+
+		if err := mp.sinceId.store(sinceId); err != nil {
+			log.Printf("Failed: storing since_id: %s\n", err)
+		}
+
+		if wait < mp.interval {
+			wait = mp.interval
+		}
+		time.Sleep(wait)
+	}
+}
+
+// poll fetches every mention newer than sinceId, paging back through the
+// timeline so a burst of more than a page of mentions is not lost. Without a
+// sinceId only the newest page is fetched. It also returns how long to wait
+// before polling again if the rate limit has been used up.
+func (mp *mentionsPoller) poll(sinceId string) ([]*Tweet, time.Duration, error) {
+	if sinceId == "" {
+		return mp.s.getMentions(map[string]string{"count": "200", "tweet_mode": "extended"})
+	}
+	return mp.s.mentionsSince(sinceId)
+}
+
+// getMentions fetches a page of the bot's mentions timeline, newest first. It
+// also returns how long to wait before asking again if the rate limit has been
+// used up.
+func (s *server) getMentions(params map[string]string) ([]*Tweet, time.Duration, error) {
+	response, err := s.consumer.Get(mentionsUrl, params, s.token)
+	if response != nil {
+		s.limits.observe(endpointMentions, response.Header)
+	}
+	wait := s.limits.wait(endpointMentions)
+	if err != nil {
+		return nil, wait, err
+	}
+	defer response.Body.Close()
+
+	b, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, wait, err
+	}
+
+	tweets := []*Tweet{}
+	if err = json.Unmarshal(b, &tweets); err != nil {
+		return nil, wait, err
+	}
+	return tweets, wait, nil
+}
+
+// idFile persists a single tweet id to disk.
+type idFile struct {
+	path string
+}
+
+// load returns the stored id, or the empty string if none has been stored.
+func (f *idFile) load() (string, error) {
+	b, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// store atomically replaces the stored id.
+func (f *idFile) store(id string) error {
+	if id == "" {
+		return nil
+	}
+	tmp := f.path + ".tmp"
+	err := ioutil.WriteFile(tmp, []byte(id+"\n"), 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// outbox holds the jobs waiting for their reply to be sent. Replies are only
+// ever sent from the outbox, one at a time as the budget for replies allows,
+// in the order their jobs were added. Their bltns are already published, so
+// only telling the requester is delayed.
+//
+// The outbox also holds notices to requesters the bot was too busy for. These
+// never wait: they are only sent while no reply is queued and there is budget
+// to spare, and are dropped otherwise.
+type outbox struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	jobs    []*job
+	notices []*Tweet
+	closed  bool
+
+	// The most notices held at once.
+	maxNotices int
+}
+
+func newOutbox(maxNotices int) *outbox {
+	o := &outbox{maxNotices: maxNotices}
+	o.cond = sync.NewCond(&o.mu)
+	return o
+}
+
+// add queues the reply of j.
+func (o *outbox) add(j *job) {
+	o.mu.Lock()
+	o.jobs = append(o.jobs, j)
+	o.cond.Signal()
+	o.mu.Unlock()
+}
+
+// addNotice queues a too busy notice to the author of tweet. It never blocks
+// and reports false if the notice was dropped because too many are held.
+func (o *outbox) addNotice(tweet *Tweet) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if len(o.notices) >= o.maxNotices {
+		return false
+	}
+	o.notices = append(o.notices, tweet)
+	o.cond.Signal()
+	return true
+}
+
+// next blocks until a reply or notice is queued and returns it, replies
+// first. It returns two nils once the outbox is closed and empty.
+func (o *outbox) next() (*job, *Tweet) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for len(o.jobs) == 0 && len(o.notices) == 0 && !o.closed {
+		o.cond.Wait()
+	}
+	if len(o.jobs) > 0 {
+		j := o.jobs[0]
+		o.jobs = o.jobs[1:]
+		return j, nil
+	}
+	if len(o.notices) > 0 {
+		tweet := o.notices[0]
+		o.notices = o.notices[1:]
+		return nil, tweet
+	}
+	return nil, nil
+}
+
+// close lets the outbox drain the replies left in it and stop.
+func (o *outbox) close() {
+	o.mu.Lock()
+	o.closed = true
+	o.cond.Broadcast()
+	o.mu.Unlock()
+}
+
+// len returns the number of queued replies.
+func (o *outbox) len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.jobs)
+}
+
+// startOutbox sends the queued replies as the budget for replies refills,
+// until the outbox is closed. The returned WaitGroup is done once every reply
+// left in it was sent.
+func (s *server) startOutbox() *sync.WaitGroup {
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			j, notice := s.outbox.next()
+			switch {
+			case j != nil:
+				err := s.sendReply(j)
+				if err != nil {
+					log.Printf("Failed: job for tweet %s: %s\n", j.id(), err)
+				}
+				s.saveJob(j)
+			case notice != nil:
+				s.sendNotice(notice)
+			default:
+				return
+			}
+		}
+	}()
+	return wg
+}
+
+// sendReply waits until the budget for replies allows it and replies to the
+// request of j.
+func (s *server) sendReply(j *job) error {
+	for {
+		s.limits.pause(endpointUpdate)
+		err := s.replyJob(j)
+		if _, ok := err.(*budgetError); !ok {
+			return err
+		}
+	}
+}
+
+// sendNotice tells the author of tweet that the bot is too busy for it, if
+// that fits in the budget for notices and replies right now.
+func (s *server) sendNotice(tweet *Tweet) {
+	if s.limits.wait(endpointNotice) > 0 || s.limits.wait(endpointUpdate) > 0 {
+		log.Printf("Info: No budget to tell @%s we are too busy\n", tweet.User.ScreenName)
+		return
+	}
+	s.limits.take(endpointNotice)
+	if err := s.respondTooBusy(tweet); err != nil {
+		log.Printf("Failed: telling @%s we are too busy: %s\n", tweet.User.ScreenName, err)
+	}
+}
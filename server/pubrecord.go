@@ -0,0 +1,47 @@
+package main
+
+import (
+	"regexp"
+
+	"github.com/soapboxsys/ombudslib/ombjson"
+	"github.com/soapboxsys/ombudslib/pubrecdb"
+)
+
+// mirrorTag is the tag every bltn mirroring a tweet starts with.
+const mirrorTag = "#RTMirror"
+
+// mirrorOf matches the first line of a mirror bltn, capturing the id of the
+// mirrored tweet. See mirrorMsg for the schema.
+var mirrorOf = regexp.MustCompile(`^#RTMirror of \[@\w+\]\(https?://\S+/status/(\d+)\)`)
+
+// pubRecord is a read only view of the node's public record database. It
+// finds tweets that were stored by other bots or users, whose bltns are not
+// in our own store.
+type pubRecord struct {
+	db *pubrecdb.PublicRecord
+}
+
+func openPubRecord(path string) (*pubRecord, error) {
+	db, err := pubrecdb.LoadDB(path)
+	if err != nil {
+		return nil, err
+	}
+	return &pubRecord{db: db}, nil
+}
+
+// findMirror searches the mirror bltns in the public record for one of the
+// tweet with id. It returns nil if there is none.
+func (pr *pubRecord) findMirror(id string) (*ombjson.JsonBltn, error) {
+	page, err := pr.db.GetTag(ombjson.Tag(mirrorTag))
+	if err != nil || page == nil {
+		return nil, err
+	}
+
+	for _, bltn := range page.Bltns {
+		m := mirrorOf.FindStringSubmatch(bltn.Message)
+		if m != nil && m[1] == id {
+			return bltn, nil
+		}
+	}
+	return nil, nil
+}
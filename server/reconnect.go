@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// maxReconnects is how many failed attempts in a row a stream will make before
+// giving up completely.
+var maxReconnects = 30
+
+// healthyConnection is how long a stream must stay up before the failures
+// that preceded it are forgotten.
+var healthyConnection = 5 * time.Minute
+
+// failKind classifies why connecting to a stream failed. Twitter asks that
+// each kind is backed off differently.
+// See: https://dev.twitter.com/streaming/overview/connecting
+type failKind int
+
+const (
+	failNetwork   failKind = iota // TCP/IP level errors.
+	failHTTP                      // HTTP errors other than rate limiting.
+	failRateLimit                 // HTTP 420 and 429 responses.
+)
+
+func (k failKind) String() string {
+	switch k {
+	case failNetwork:
+		return "network"
+	case failHTTP:
+		return "http"
+	case failRateLimit:
+		return "rate limit"
+	}
+	return "unknown"
+}
+
+// backoffPolicy describes how long to wait before each attempt to reconnect.
+// Linear policies add start on every attempt while the rest double.
+type backoffPolicy struct {
+	start  time.Duration
+	max    time.Duration
+	linear bool
+}
+
+var backoffPolicies = map[failKind]backoffPolicy{
+	failNetwork:   {start: 250 * time.Millisecond, max: 16 * time.Second, linear: true},
+	failHTTP:      {start: 5 * time.Second, max: 320 * time.Second},
+	failRateLimit: {start: time.Minute, max: 32 * time.Minute},
+}
+
+// delay returns the wait before the nth attempt, counting from zero.
+func (p backoffPolicy) delay(n int) time.Duration {
+	d := p.start
+	for i := 0; i < n && d < p.max; i++ {
+		if p.linear {
+			d += p.start
+		} else {
+			d *= 2
+		}
+	}
+	if d > p.max {
+		d = p.max
+	}
+	return d
+}
+
+// classifyFailure determines the kind of failure from the result of trying to
+// open a stream.
+func classifyFailure(resp *http.Response) failKind {
+	if resp == nil {
+		return failNetwork
+	}
+	switch resp.StatusCode {
+	case 420, 429:
+		return failRateLimit
+	}
+	return failHTTP
+}
+
+// reconnector opens a stream and keeps reopening it with the same request
+// whenever it drops, backing off between failed attempts.
+type reconnector struct {
+	name        string
+	open        func() (*http.Response, error)
+	attempts    map[failKind]int
+	connectedAt time.Time
+}
+
+func newReconnector(name string, open func() (*http.Response, error)) *reconnector {
+	return &reconnector{
+		name:     name,
+		open:     open,
+		attempts: make(map[failKind]int),
+	}
+}
+
+// connect opens the stream, retrying until it succeeds or maxReconnects
+// attempts in a row have failed.
+func (r *reconnector) connect() (*http.Response, error) {
+	// A connection that stayed up long enough wipes the slate clean.
+	if !r.connectedAt.IsZero() && time.Since(r.connectedAt) >= healthyConnection {
+		r.attempts = make(map[failKind]int)
+	}
+
+	for i := 0; i < maxReconnects; i++ {
+		resp, err := r.open()
+		if err == nil && resp.StatusCode == http.StatusOK {
+			r.connectedAt = time.Now()
+			return resp, nil
+		}
+
+		if err == nil {
+			resp.Body.Close()
+			err = fmt.Errorf("%s", resp.Status)
+		}
+
+		kind := classifyFailure(resp)
+		backoff := backoffPolicies[kind].delay(r.attempts[kind])
+		r.attempts[kind] += 1
+		stats.Add(statConnectFails, 1)
+
+		log.Printf("Saw %s error from %s stream: %s. Backing off for: %s\n",
+			kind, r.name, err, backoff)
+		time.Sleep(backoff)
+	}
+	return nil, fmt.Errorf("Could not connect to %s stream after %d attempts", r.name, maxReconnects)
+}
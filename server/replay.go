@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// replayFile is a TweetSource that reads newline delimited tweet JSON, exactly
+// as it was read off of the streaming endpoint, from a file. Lines that are not
+// statuses, such as keep-alives and control messages, are skipped.
+type replayFile struct {
+	path string
+	// speed scales the delay between tweets relative to when they were
+	// originally sent. A speed of 2 replays twice as fast, 0 replays as fast
+	// as possible.
+	speed float64
+}
+
+func newReplayFile(path string, speed float64) *replayFile {
+	return &replayFile{path: path, speed: speed}
+}
+
+// sentAt holds the millisecond timestamp twitter adds to every streamed status.
+type sentAt struct {
+	TimestampMs string `json:"timestamp_ms"`
+}
+
+func (r *replayFile) Run(out chan<- *Tweet) error {
+	f, err := os.Open(r.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	log.Printf("Replaying %s at %gx speed\n", r.path, r.speed)
+
+	reader := bufio.NewReader(f)
+	lines := 0
+	var last int64
+	for {
+		str, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		if str != "" {
+			lines += 1
+			tweet, ok := decodeReplayLine(str)
+			if ok {
+				last = r.wait(str, last)
+				out <- tweet
+			}
+		}
+
+		if err == io.EOF {
+			log.Printf("Info: Replayed %d lines from %s\n", lines, r.path)
+			return nil
+		}
+	}
+}
+
+// decodeReplayLine turns a captured line from either the v1.1 or the v2 stream
+// into a Tweet. Lines that do not hold a status are rejected.
+func decodeReplayLine(str string) (*Tweet, bool) {
+	if tweet, err := decodeV2Payload(str); err == nil {
+		return tweet, true
+	}
+	if _, isCtrl := decodeStreamMessage(str); isCtrl {
+		return nil, false
+	}
+	tweet, err := decodeTweet(str)
+	if err != nil {
+		return nil, false
+	}
+	return tweet, true
+}
+
+// wait sleeps for the time that passed between the previous tweet and the one
+// in str, scaled by the replay speed. It returns the timestamp of str so it can
+// be passed back in with the next line.
+func (r *replayFile) wait(str string, last int64) int64 {
+	var sa sentAt
+	if err := json.Unmarshal([]byte(str), &sa); err != nil {
+		return last
+	}
+	ts, err := strconv.ParseInt(sa.TimestampMs, 10, 64)
+	if err != nil {
+		return last
+	}
+
+	if r.speed > 0 && last != 0 && ts > last {
+		delay := time.Duration(float64(ts-last)/r.speed) * time.Millisecond
+		time.Sleep(delay)
+	}
+	return ts
+}
@@ -11,6 +11,7 @@ import (
 	"net"
 	"net/http"
 	"strings"
+	"sync/atomic"
 
 	"github.com/btcsuite/btcd/btcjson"
 	_ "github.com/soapboxsys/ombudslib/rpcexten"
@@ -118,8 +119,8 @@ func (s *server) rpcsend(cmd interface{}) (string, error) {
 	// Marshal the command into a JSON-RPC byte slice in preparation for
 	// sending it to the RPC server.
 
-	s.cnt += 1
-	marshalledJSON, err := btcjson.MarshalCmd(s.cnt, cmd)
+	id := atomic.AddInt64(&s.cnt, 1)
+	marshalledJSON, err := btcjson.MarshalCmd(id, cmd)
 	if err != nil {
 		return "", err
 	}
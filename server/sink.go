@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strconv"
+
+	"github.com/soapboxsys/ombudslib/ombpublish"
+	"github.com/soapboxsys/ombudslib/ombwire"
+)
+
+// A sink carries out the calls the bot makes to Twitter and the wallet. The
+// rest of the pipeline decides what to call and keeps to the budgets.
+type sink interface {
+	// fetchTweet fetches a single tweet from Twitter. Like postReply it
+	// returns a budgetError if Twitter refused the call for its rate limit.
+	fetchTweet(id string) (*Tweet, error)
+	// publishBltn publishes a bltn with the wallet, returning its txid.
+	publishBltn(bltn *ombwire.Bulletin) (string, error)
+	// postReply posts status to Twitter in reply to tweet.
+	postReply(tweet *Tweet, status string) error
+}
+
+// liveSink calls Twitter and the wallet for real.
+type liveSink struct {
+	s *server
+}
+
+func (ls *liveSink) fetchTweet(id string) (*Tweet, error) {
+	s := ls.s
+	url := fmt.Sprintf("https://api.twitter.com/1.1/statuses/show/%s.json", id)
+	response, err := s.consumer.Get(url, map[string]string{"tweet_mode": "extended"}, s.token)
+	if response != nil {
+		s.limits.observe(endpointShow, response.Header)
+	}
+	if err != nil {
+		if limited := s.limits.refused(endpointShow, response); limited != nil {
+			return nil, limited
+		}
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		return nil, fmt.Errorf("Could not get tweet: %s", id)
+	}
+	b, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	tweet := &Tweet{}
+	if err = json.Unmarshal(b, tweet); err != nil {
+		return nil, err
+	}
+
+	return tweet, nil
+}
+
+func (ls *liveSink) publishBltn(bltn *ombwire.Bulletin) (string, error) {
+	s := ls.s
+	txid, err := ombpublish.PublishBulletin(s.rpcClient, bltn, *s.pubParams)
+	if err == nil && txid == nil {
+		err = fmt.Errorf("no txid returned")
+	}
+	if err != nil {
+		return "", err
+	}
+	return txid.String(), nil
+}
+
+func (ls *liveSink) postReply(tweet *Tweet, status string) error {
+	s := ls.s
+	response, err := s.consumer.Post(
+		"https://api.twitter.com/1.1/statuses/update.json",
+		map[string]string{
+			"status":                status,
+			"in_reply_to_status_id": tweet.IdString(),
+		},
+		s.token,
+	)
+	if response != nil {
+		s.limits.observe(endpointUpdate, response.Header)
+	}
+
+	if err != nil {
+		if limited := s.limits.refused(endpointUpdate, response); limited != nil {
+			return limited
+		}
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+// dryRunSink logs the calls the bot would have made instead of making them,
+// so a replay never reaches Twitter or the wallet.
+type dryRunSink struct{}
+
+// fetchTweet cannot know anything about a tweet that was not in the replay, so
+// it stands in a tweet with only its id.
+func (dryRunSink) fetchTweet(id string) (*Tweet, error) {
+	log.Printf("Info: Dry run, would fetch tweet %s\n", id)
+	tweet := &Tweet{IdStr: id, Text: "(not fetched in a dry run)"}
+	tweet.Id, _ = strconv.ParseInt(id, 10, 64)
+	tweet.User.ScreenName = "unknown"
+	return tweet, nil
+}
+
+// publishBltn makes up a txid from the bltn's message so replays of the same
+// tweets log the same txids.
+func (dryRunSink) publishBltn(bltn *ombwire.Bulletin) (string, error) {
+	txid := "dryrun-" + messageHash(bltn.GetMessage())[:16]
+	log.Printf("Info: Dry run, would publish bltn %s:\n%s\n", txid, bltn.GetMessage())
+	return txid, nil
+}
+
+func (dryRunSink) postReply(tweet *Tweet, status string) error {
+	log.Printf("Info: Dry run, would reply to tweet %s: %s\n", tweet.IdString(), status)
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net/http"
+)
+
+// A TweetSource produces the tweets that are fed through the archiving
+// pipeline. Run pushes every decoded tweet it sees into out and blocks until
+// the source is exhausted or can no longer continue. A source that simply ran
+// out of input returns nil.
+type TweetSource interface {
+	Run(out chan<- *Tweet) error
+}
+
+// newSource picks the TweetSource the server was configured to read from.
+func (s *server) newSource() TweetSource {
+	if s.cfg.Replay != "" {
+		return newReplayFile(s.cfg.Replay, s.cfg.ReplaySpeed)
+	}
+
+	switch s.cfg.Source {
+	case sourceV2:
+		return newV2Stream(s)
+	case sourceMentions:
+		return newMentionsPoller(s)
+	case sourceWebhook:
+		return newWebhookSource(s)
+	default:
+		return newFilterStream(s)
+	}
+}
+
+// run drives the archiving pipeline with the tweets produced by src. Requests
+// are accepted as they are read and handed to the workers, so a slow request
+// never holds up reading the source. It returns once src has stopped and every
+// tweet it produced has been handled.
+func (s *server) run(src TweetSource) error {
+	workers := s.startWorkers(s.cfg.Workers)
+	// Pick up the jobs the last run was working on or left spilled.
+	s.resumeJobs()
+	s.unspill()
+
+	tweets := make(chan *Tweet)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- src.Run(tweets)
+		s.backfills.Wait()
+		close(tweets)
+	}()
+
+	for tweet := range tweets {
+		if !s.seen.add(tweet.Id) {
+			continue
+		}
+		if s.detectTweet(tweet) {
+			err := s.handleIncomingTweet(tweet)
+			if err != nil {
+				log.Println(err.Error())
+			}
+		}
+		s.markProcessed(tweet)
+	}
+
+	s.work.close()
+	workers.Wait()
+	return <-errc
+}
+
+// filterStream is a TweetSource backed by Twitter's statuses/filter streaming
+// endpoint. It tracks the hashtag the server is configured with.
+type filterStream struct {
+	s  *server
+	rc *reconnector
+}
+
+func newFilterStream(s *server) *filterStream {
+	fs := &filterStream{s: s}
+	fs.rc = newReconnector("filter", fs.open)
+	return fs
+}
+
+// open makes a single request for the stream. Every reconnect goes through it
+// so the stream always comes back with the endpoint and parameters it started
+// with.
+func (fs *filterStream) open() (*http.Response, error) {
+	return fs.s.consumer.Get(
+		"https://stream.twitter.com/1.1/statuses/filter.json",
+		map[string]string{
+			"track":          fs.s.track(),
+			"stall_warnings": "true",
+		},
+		fs.s.token)
+}
+
+// track returns what the stream is asked to match. Tweets only need to mention
+// the bot when the trigger ignores the hashtag.
+func (s *server) track() string {
+	if s.cfg.Trigger == triggerMention {
+		return "@" + s.cfg.BotScreenName
+	}
+	return s.triggerTags.track()
+}
+
+// connect opens the stream, backing off as needed, and guards it against
+// stalls.
+func (fs *filterStream) connect() (io.ReadCloser, error) {
+	response, err := fs.rc.connect()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Connected to %s stream\n", fs.s.track())
+	return newWatchdogReader(response.Body, fs.s.cfg.StallTimeout), nil
+}
+
+func (fs *filterStream) Run(out chan<- *Tweet) error {
+	s := fs.s
+	body, err := fs.connect()
+	if err != nil {
+		return err
+	}
+	defer func() { body.Close() }()
+	s.startBackfill(out)
+
+	reader := bufio.NewReader(body)
+	st := &streamState{}
+
+	for {
+		str, err := reader.ReadString('\n')
+		s.captureLine(str)
+
+		msg, isCtrl := decodeStreamMessage(str)
+		if err == nil && isCtrl {
+			err = s.handleStreamMessage(msg, st)
+		}
+
+		if err != nil {
+			log.Printf("Reading from twitter threw %s\n", err)
+			body.Close()
+			newBody, err := fs.connect()
+			if err != nil {
+				return err
+			}
+			body = newBody
+			reader = bufio.NewReader(body)
+			st = &streamState{}
+			s.startBackfill(out)
+			continue
+		}
+
+		if isCtrl {
+			continue
+		}
+
+		// Keep-alives and anything else that is not a status are
+		// dropped here.
+		tweet, err := decodeTweet(str)
+		if err != nil {
+			continue
+		}
+		out <- tweet
+	}
+}
+
+// captureLine records a raw line read from the stream if capturing is enabled.
+// A failure to capture is logged but never interrupts the stream.
+func (s *server) captureLine(str string) {
+	if s.capture == nil || str == "" {
+		return
+	}
+	if err := s.capture.Write(str); err != nil {
+		log.Printf("Failed: capturing stream line: %s\n", err)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+)
+
+// stats are counters operators can watch to see how the bot is doing. They
+// are served as JSON at /debug/vars when --statslisten is set.
+var stats = expvar.NewMap("retweeter")
+
+// Names of the counters kept in stats.
+const (
+	statStalls       = "stream_stalls"           // Streams dropped for going silent.
+	statConnectFails = "stream_connect_failures" // Failed attempts to open a stream.
+	statDropped      = "jobs_dropped"            // Requests turned away by a full queue.
+	statQueueDepth   = "queue_depth"             // Jobs waiting for a worker in memory.
+	statSpilled      = "queue_spilled"           // Jobs waiting for a worker on disk.
+	statDeferred     = "replies_deferred"        // Replies waiting for the budget to refill.
+)
+
+// watchQueue publishes the depth of q in stats.
+func watchQueue(q *workQueue) {
+	stats.Set(statQueueDepth, expvar.Func(func() interface{} { return q.len() }))
+	stats.Set(statSpilled, expvar.Func(func() interface{} { return q.numSpilled() }))
+}
+
+// watchOutbox publishes the number of deferred replies in stats.
+func watchOutbox(o *outbox) {
+	stats.Set(statDeferred, expvar.Func(func() interface{} { return o.len() }))
+}
+
+// serveStats exposes stats over HTTP on addr. It is meant to be run in its
+// own goroutine.
+func serveStats(addr string) {
+	log.Printf("Serving stats on http://%s/debug/vars\n", addr)
+	err := http.ListenAndServe(addr, nil)
+	if err != nil {
+		log.Printf("Failed: serving stats: %s\n", err)
+	}
+}
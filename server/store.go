@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// store holds the state the bot keeps on disk in an embedded bolt database.
+type store struct {
+	db *bolt.DB
+}
+
+var (
+	// Maps the id of every tweet we archived to its archiveRecord.
+	archivedBucket = []byte("archived")
+	// Maps the id of every request the bot is working on to its job. Keys
+	// are zero padded so the jobs sort by request, oldest first.
+	jobsBucket = []byte("jobs")
+	// Jobs waiting on disk for room in the queue, keyed like jobsBucket.
+	spilledBucket = []byte("spilled")
+	// Maps the id of every request that was replied to or failed to its
+	// finishedJob.
+	finishedBucket = []byte("finished")
+	// Maps each rate limited endpoint to what is left of its budget.
+	limitsBucket = []byte("limits")
+)
+
+// archiveRecord describes how and when a tweet was stored in the public record
+// and what has happened to the tweet on Twitter since.
+type archiveRecord struct {
+	TweetId    string     `json:"tweet_id"`
+	Txid       string     `json:"txid"`
+	BltnHash   string     `json:"bltn_hash"` // Hex encoded sha256 of the bltn's message.
+	Time       time.Time  `json:"time"`
+	Deleted    *time.Time `json:"deleted,omitempty"`     // When the author deleted the tweet.
+	WithheldIn []string   `json:"withheld_in,omitempty"` // Where the tweet was withheld.
+}
+
+// openStore opens the database at path, creating it if it does not exist yet.
+func openStore(path string) (*store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{archivedBucket, jobsBucket, spilledBucket, finishedBucket, limitsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &store{db: db}, nil
+}
+
+// archived looks up the record for a tweet. The record is nil if the tweet
+// was never archived.
+func (st *store) archived(tweetId string) (*archiveRecord, error) {
+	var rec *archiveRecord
+	err := st.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(archivedBucket).Get([]byte(tweetId))
+		if b == nil {
+			return nil
+		}
+		rec = &archiveRecord{}
+		return json.Unmarshal(b, rec)
+	})
+	return rec, err
+}
+
+// putArchived stores the record of an archived tweet.
+func (st *store) putArchived(rec *archiveRecord) error {
+	return st.db.Update(func(tx *bolt.Tx) error {
+		return putJson(tx.Bucket(archivedBucket), rec.TweetId, rec)
+	})
+}
+
+// updateArchived applies fn to the record of an archived tweet. It reports
+// whether the tweet was archived at all.
+func (st *store) updateArchived(tweetId string, fn func(*archiveRecord)) (bool, error) {
+	found := false
+	err := st.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(archivedBucket)
+		b := bucket.Get([]byte(tweetId))
+		if b == nil {
+			return nil
+		}
+
+		rec := &archiveRecord{}
+		if err := json.Unmarshal(b, rec); err != nil {
+			return err
+		}
+		found = true
+		fn(rec)
+		return putJson(bucket, tweetId, rec)
+	})
+	return found, err
+}
+
+// finishedJob is all that is kept of a job once it is done, enough to know
+// the request was handled.
+type finishedJob struct {
+	State   jobState  `json:"state"`
+	Updated time.Time `json:"updated"`
+}
+
+// jobKey is the key of the job for the request with id.
+func jobKey(id int64) []byte {
+	return []byte(fmt.Sprintf("%020d", id))
+}
+
+// addJob stores a newly accepted job. It reports false, leaving the stored job
+// alone, if its request was accepted before.
+func (st *store) addJob(j *job) (bool, error) {
+	added := false
+	key := jobKey(j.Request.Id)
+	err := st.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{jobsBucket, spilledBucket, finishedBucket} {
+			if tx.Bucket(name).Get(key) != nil {
+				return nil
+			}
+		}
+		added = true
+		return putJson(tx.Bucket(jobsBucket), string(key), j)
+	})
+	return added, err
+}
+
+// putJob stores the progress of a job. Once the job is done only a
+// finishedJob is kept of it.
+func (st *store) putJob(j *job) error {
+	key := jobKey(j.Request.Id)
+	return st.db.Update(func(tx *bolt.Tx) error {
+		if !j.done() {
+			return putJson(tx.Bucket(jobsBucket), string(key), j)
+		}
+		if err := tx.Bucket(jobsBucket).Delete(key); err != nil {
+			return err
+		}
+		if err := tx.Bucket(spilledBucket).Delete(key); err != nil {
+			return err
+		}
+		return putJson(tx.Bucket(finishedBucket), string(key), &finishedJob{j.State, j.Updated})
+	})
+}
+
+// spillJob moves a job to disk until there is room for it in the queue.
+func (st *store) spillJob(j *job) error {
+	key := jobKey(j.Request.Id)
+	return st.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(jobsBucket).Delete(key); err != nil {
+			return err
+		}
+		return putJson(tx.Bucket(spilledBucket), string(key), j)
+	})
+}
+
+// unspillJobs takes at most n of the spilled jobs off disk, oldest request
+// first, and stores them as jobs being worked on again.
+func (st *store) unspillJobs(n int) ([]*job, error) {
+	jobs := []*job{}
+	err := st.db.Update(func(tx *bolt.Tx) error {
+		spilled := tx.Bucket(spilledBucket)
+		c := spilled.Cursor()
+		keys := [][]byte{}
+		for k, v := c.First(); k != nil && len(jobs) < n; k, v = c.Next() {
+			j := &job{}
+			if err := json.Unmarshal(v, j); err != nil {
+				return err
+			}
+			jobs = append(jobs, j)
+			keys = append(keys, k)
+		}
+
+		for i, k := range keys {
+			if err := spilled.Delete(k); err != nil {
+				return err
+			}
+			if err := putJson(tx.Bucket(jobsBucket), string(k), jobs[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// spilledJobs returns the jobs spilled to disk, oldest request first.
+func (st *store) spilledJobs() ([]*job, error) {
+	return st.jobsIn(spilledBucket)
+}
+
+// unfinishedJobs returns the jobs that were interrupted before they were
+// replied to or failed, oldest request first. Spilled jobs are left on disk.
+func (st *store) unfinishedJobs() ([]*job, error) {
+	return st.jobsIn(jobsBucket)
+}
+
+func (st *store) jobsIn(name []byte) ([]*job, error) {
+	jobs := []*job{}
+	err := st.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(name).ForEach(func(k, v []byte) error {
+			j := &job{}
+			if err := json.Unmarshal(v, j); err != nil {
+				return err
+			}
+			jobs = append(jobs, j)
+			return nil
+		})
+	})
+	return jobs, err
+}
+
+// bucket reads the stored budget of endpoint into b. It reports false, leaving
+// b alone, if none was stored.
+func (st *store) bucket(endpoint string, b *tokenBucket) (bool, error) {
+	found := false
+	err := st.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(limitsBucket).Get([]byte(endpoint))
+		if v == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(v, b)
+	})
+	return found, err
+}
+
+// putBucket stores what is left of the budget of endpoint.
+func (st *store) putBucket(endpoint string, b *tokenBucket) error {
+	return st.db.Update(func(tx *bolt.Tx) error {
+		return putJson(tx.Bucket(limitsBucket), endpoint, b)
+	})
+}
+
+func putJson(bucket *bolt.Bucket, key string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(key), b)
+}
+
+func (st *store) Close() error {
+	return st.db.Close()
+}
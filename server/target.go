@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+)
+
+// targetKind describes how the tweet that gets archived relates to the tweet
+// that asked for it.
+type targetKind int
+
+const (
+	targetSelf    targetKind = iota // The request itself is archived.
+	targetParent                    // The tweet the request replied to.
+	targetRetweet                   // The original of a retweeted request.
+	targetQuote                     // The tweet the request quoted.
+	targetLink                      // A tweet the request linked to.
+)
+
+// target is a tweet that a request asks to be archived.
+type target struct {
+	Tweet *Tweet     `json:"tweet"`
+	Kind  targetKind `json:"kind"`
+}
+
+// statusUrl matches links to a single tweet on twitter.com or x.com, capturing
+// the tweet's id.
+var statusUrl = regexp.MustCompile(
+	`^https?://(?:(?:www|mobile)\.)?(?:twitter|x)\.com/(?:#!/)?(?:i/web|\w+)/status(?:es)?/(\d+)`)
+
+// linkedStatusIds returns the ids of the tweets linked to in tweet, in the
+// order they appear.
+func linkedStatusIds(tweet *Tweet) []string {
+	ids := []string{}
+	for _, u := range tweet.FullEntities().Urls {
+		m := statusUrl.FindStringSubmatch(u.ExpandedUrl)
+		if m != nil {
+			ids = append(ids, m[1])
+		}
+	}
+	return ids
+}
+
+// findTargets determines which tweets a request asks to be archived and
+// fetches them from Twitter if needed. A retweet asks for its original. A quote
+// tweet asks for the tweet it quotes and a tweet with links to other tweets
+// asks for each of them. Otherwise a reply asks for its parent and any other
+// tweet asks for itself.
+func (s *server) findTargets(tweet *Tweet) ([]*target, error) {
+	// Figure out if the tweet is a reply and if so, record what the
+	// original poster said. Use the in_reply_to_status field to determine
+	// if the server will respond to the original tweet or its parent.
+	// All responses via tweet are too the person that tweeted at the bot
+	// though.
+	if tweet.RetweetedStatus != nil {
+		original, err := s.complete(tweet.RetweetedStatus)
+		if err != nil {
+			return nil, err
+		}
+		return []*target{{original, targetRetweet}}, nil
+	}
+
+	targets := []*target{}
+	seen := map[string]bool{tweet.IdString(): true}
+	var lastErr error
+
+	// add fetches the tweet with id unless it is already a target. A tweet
+	// that cannot be fetched is skipped so the others can still be stored.
+	add := func(id string, partial *Tweet, kind targetKind) {
+		if seen[id] {
+			return
+		}
+		seen[id] = true
+
+		var t *Tweet
+		var err error
+		if partial != nil {
+			t, err = s.complete(partial)
+		} else {
+			t, err = s.getTweet(id)
+		}
+		if err != nil {
+			log.Printf("Failed: could not get tweet %s: %s\n", id, err)
+			lastErr = err
+			return
+		}
+		targets = append(targets, &target{t, kind})
+	}
+
+	if tweet.QuotedStatus != nil {
+		add(tweet.QuotedStatus.IdString(), tweet.QuotedStatus, targetQuote)
+	} else if tweet.QuotedStatusIdStr != "" {
+		add(tweet.QuotedStatusIdStr, nil, targetQuote)
+	}
+
+	// Quote tweets also link to the tweet they quote, which was just added.
+	for _, id := range linkedStatusIds(tweet) {
+		add(id, nil, targetLink)
+	}
+
+	if len(targets) > 0 {
+		return targets, nil
+	}
+	if lastErr != nil {
+		return nil, lastErr
+	}
+
+	if tweet.ParentIdStr != "" {
+		parent, err := s.getTweet(tweet.ParentIdStr)
+		if err != nil {
+			return nil, err
+		}
+		return []*target{{parent, targetParent}}, nil
+	}
+	return []*target{{tweet, targetSelf}}, nil
+}
+
+// complete returns the full version of a tweet that was only partially
+// delivered, such as a nested status that Twitter did not expand.
+func (s *server) complete(tweet *Tweet) (*Tweet, error) {
+	if tweet.Body() != "" && tweet.User.ScreenName != "" {
+		return tweet, nil
+	}
+	return s.getTweet(tweet.IdString())
+}
+
+// describe says which tweets were archived in the words of a reply to the
+// person who asked for them.
+func describe(targets []*target) string {
+	if len(targets) > 1 {
+		for _, t := range targets {
+			if t.Kind != targetLink {
+				return fmt.Sprintf("the %d tweets you asked for have", len(targets))
+			}
+		}
+		return fmt.Sprintf("the %d tweets you linked to have", len(targets))
+	}
+	switch targets[0].Kind {
+	case targetParent:
+		return "the tweet you originally replied to has"
+	case targetQuote:
+		return "the tweet you quoted has"
+	case targetRetweet:
+		return "the tweet you retweeted has"
+	case targetLink:
+		return "the tweet you linked to has"
+	}
+	return "Your tweet has"
+}
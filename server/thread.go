@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/soapboxsys/ombudslib/ombwire"
+)
+
+// wantsThread determines if the request asks for the whole conversation
+// above the target to be archived, either because the server always does so
+// or because the request contains the thread keyword.
+func (s *server) wantsThread(req *Tweet) bool {
+	if s.cfg.Threads {
+		return true
+	}
+	if s.cfg.ThreadKeyword == "" {
+		return false
+	}
+
+	words := strings.FieldsFunc(req.Body(), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	for _, w := range words {
+		if strings.EqualFold(w, s.cfg.ThreadKeyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchThread walks up the in_reply_to chain from tweet to the root of the
+// conversation, fetching at most ThreadDepth tweets in total. The thread is
+// returned root first. If a parent cannot be fetched, because it was deleted
+// or is protected, the thread starts below it.
+func (s *server) fetchThread(tweet *Tweet) []*Tweet {
+	thread := []*Tweet{tweet}
+	cur := tweet
+	for len(thread) < s.cfg.ThreadDepth && cur.ParentIdStr != "" {
+		parent, err := s.getTweet(cur.ParentIdStr)
+		if err != nil {
+			log.Printf("Failed: could not get tweet %s of thread: %s\n", cur.ParentIdStr, err)
+			break
+		}
+		thread = append(thread, parent)
+		cur = parent
+	}
+
+	for i, j := 0, len(thread)-1; i < j; i, j = i+1, j-1 {
+		thread[i], thread[j] = thread[j], thread[i]
+	}
+	return thread
+}
+
+// publishThread publishes a thread as a series of bltns, each linking to the
+// one before it. It returns the txid of the bltn of the root of the thread.
+func (s *server) publishThread(thread []*Tweet) (string, error) {
+	root := ""
+	prev := ""
+	for i, tweet := range thread {
+		wireBltn := s.makeThreadBltn(tweet, i+1, len(thread), prev)
+		rec, _, err := s.publish(tweet, wireBltn)
+		if err != nil {
+			return "", fmt.Errorf("bltn %d of %d of thread: %s", i+1, len(thread), err)
+		}
+
+		prev = rec.Txid
+		if i == 0 {
+			root = prev
+		}
+	}
+	return root, nil
+}
+
+// makeThreadBltn creates the bltn for a single tweet of a thread.
+func (s *server) makeThreadBltn(tweet *Tweet, part, total int, prevTxid string) *ombwire.Bulletin {
+	// Schema for the bltns of a thread adds a trailer to the usual schema:
+	// #RTMirror of [@username](https://twtr.com/uname/status/345345345343433)
+	// TWEET BODY TWEET BODY
+	//
+	// Part 2 of 3 of a thread, continuing from bltn TXID
+	msg := mirrorMsg(tweet)
+	msg += fmt.Sprintf("\n\nPart %d of %d of a thread", part, total)
+	if prevTxid != "" {
+		msg += fmt.Sprintf(", continuing from bltn %s", prevTxid)
+	}
+
+	now := uint64(time.Now().Unix())
+	return ombwire.NewBulletin(msg, now, nil)
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	v2StreamUrl = "https://api.twitter.com/2/tweets/search/stream"
+	v2RulesUrl  = "https://api.twitter.com/2/tweets/search/stream/rules"
+)
+
+// v2Stream is a TweetSource backed by Twitter's v2 filtered stream. Unlike the
+// v1.1 stream it authenticates with an app bearer token and matches tweets
+// against rules that are stored server side by Twitter.
+type v2Stream struct {
+	s      *server
+	client *http.Client
+	rc     *reconnector
+}
+
+func newV2Stream(s *server) *v2Stream {
+	vs := &v2Stream{
+		s:      s,
+		client: &http.Client{},
+	}
+	vs.rc = newReconnector("v2 filtered", vs.open)
+	return vs
+}
+
+// v2Payload is a single message pushed out by the v2 filtered stream.
+type v2Payload struct {
+	Data     *v2Tweet `json:"data"`
+	Includes struct {
+		Users  []v2User  `json:"users"`
+		Tweets []v2Tweet `json:"tweets"`
+	} `json:"includes"`
+	Errors []v2Error `json:"errors"`
+}
+
+type v2Tweet struct {
+	Id               string `json:"id"`
+	Text             string `json:"text"`
+	AuthorId         string `json:"author_id"`
+	CreatedAt        string `json:"created_at"`
+	ReferencedTweets []struct {
+		Type string `json:"type"` // One of retweeted, quoted or replied_to
+		Id   string `json:"id"`
+	} `json:"referenced_tweets"`
+	Entities struct {
+		Hashtags []struct {
+			Start int    `json:"start"`
+			End   int    `json:"end"`
+			Tag   string `json:"tag"`
+		} `json:"hashtags"`
+		Mentions []struct {
+			Start    int    `json:"start"`
+			End      int    `json:"end"`
+			Username string `json:"username"`
+			Id       string `json:"id"`
+		} `json:"mentions"`
+		Urls []struct {
+			Start       int    `json:"start"`
+			End         int    `json:"end"`
+			Url         string `json:"url"`
+			ExpandedUrl string `json:"expanded_url"`
+			DisplayUrl  string `json:"display_url"`
+		} `json:"urls"`
+	} `json:"entities"`
+}
+
+type v2User struct {
+	Id       string `json:"id"`
+	Name     string `json:"name"`
+	Username string `json:"username"`
+}
+
+type v2Error struct {
+	Title  string `json:"title"`
+	Detail string `json:"detail"`
+}
+
+// v2Rule is a filtered stream rule as stored by Twitter.
+type v2Rule struct {
+	Id    string `json:"id,omitempty"`
+	Value string `json:"value"`
+}
+
+// decodeV2Payload determines if str is a tweet pushed out by the v2 stream and
+// converts it into a Tweet.
+func decodeV2Payload(str string) (*Tweet, error) {
+	p := &v2Payload{}
+	err := json.Unmarshal([]byte(str), p)
+	if err != nil {
+		return nil, err
+	}
+	if p.Data == nil {
+		return nil, fmt.Errorf("v2 payload has no data")
+	}
+	return p.tweet()
+}
+
+// v2StreamError returns the error Twitter sent down the stream in str, if
+// any. Errors sent alongside a tweet only concern its expansions and are
+// ignored, but an error on its own means the stream is being closed.
+func v2StreamError(str string) error {
+	p := &v2Payload{}
+	err := json.Unmarshal([]byte(str), p)
+	if err != nil || p.Data != nil || len(p.Errors) == 0 {
+		return nil
+	}
+	e := p.Errors[0]
+	return fmt.Errorf("v2 stream error %s: %s", e.Title, e.Detail)
+}
+
+// tweet converts the payload into the Tweet model the rest of the bot uses.
+func (p *v2Payload) tweet() (*Tweet, error) {
+	tweet, err := p.convert(p.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ref := range p.Data.ReferencedTweets {
+		switch ref.Type {
+		case "retweeted":
+			tweet.RetweetedStatus = p.included(ref.Id)
+		case "quoted":
+			tweet.QuotedStatusIdStr = ref.Id
+			tweet.QuotedStatus = p.included(ref.Id)
+		case "replied_to":
+			tweet.ParentIdStr = ref.Id
+			tweet.ParentId, _ = strconv.ParseInt(ref.Id, 10, 64)
+		}
+	}
+	return tweet, nil
+}
+
+// convert maps a single v2 tweet onto a Tweet, filling in its author from the
+// included users.
+func (p *v2Payload) convert(d *v2Tweet) (*Tweet, error) {
+	id, err := strconv.ParseInt(d.Id, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	// v2 text is never truncated.
+	tweet := &Tweet{
+		Id:    id,
+		IdStr: d.Id,
+		Text:  d.Text,
+	}
+
+	if created, err := time.Parse(time.RFC3339, d.CreatedAt); err == nil {
+		tweet.CreatedAt = created.Format(time.RubyDate)
+	}
+
+	for _, u := range p.Includes.Users {
+		if u.Id == d.AuthorId {
+			tweet.User.IdStr = u.Id
+			tweet.User.Id, _ = strconv.ParseInt(u.Id, 10, 64)
+			tweet.User.ScreenName = u.Username
+			tweet.User.Name = u.Name
+		}
+	}
+
+	for _, ht := range d.Entities.Hashtags {
+		tweet.Ents.HashTags = append(tweet.Ents.HashTags, HashTag{
+			Text:    ht.Tag,
+			Indices: []int{ht.Start, ht.End},
+		})
+	}
+
+	for _, m := range d.Entities.Mentions {
+		tweet.Ents.UserMentions = append(tweet.Ents.UserMentions, UserMention{
+			IdStr:      m.Id,
+			ScreenName: m.Username,
+			Indices:    []int{m.Start, m.End},
+		})
+	}
+
+	for _, u := range d.Entities.Urls {
+		tweet.Ents.Urls = append(tweet.Ents.Urls, UrlEntity{
+			Url:         u.Url,
+			ExpandedUrl: u.ExpandedUrl,
+			DisplayUrl:  u.DisplayUrl,
+			Indices:     []int{u.Start, u.End},
+		})
+	}
+	return tweet, nil
+}
+
+// included returns the referenced tweet with id if Twitter expanded it into
+// the payload. Otherwise only the id of the tweet is known.
+func (p *v2Payload) included(id string) *Tweet {
+	for i := range p.Includes.Tweets {
+		if p.Includes.Tweets[i].Id == id {
+			tweet, err := p.convert(&p.Includes.Tweets[i])
+			if err == nil {
+				return tweet
+			}
+		}
+	}
+	tweet := &Tweet{IdStr: id}
+	tweet.Id, _ = strconv.ParseInt(id, 10, 64)
+	return tweet
+}
+
+// do makes a request against the v2 api authorized with the bearer token.
+func (vs *v2Stream) do(method, u string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+vs.s.cfg.BearerToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return vs.client.Do(req)
+}
+
+// rules returns the rules the stream should match. When none are configured
+// the rule is derived from the trigger policy and hashtags.
+func (vs *v2Stream) rules() []string {
+	s := vs.s
+	if len(s.cfg.StreamRules) > 0 {
+		return s.cfg.StreamRules
+	}
+
+	mention := "@" + s.cfg.BotScreenName
+	switch s.cfg.Trigger {
+	case triggerMention:
+		return []string{mention}
+	case triggerHashtag:
+		return []string{s.triggerTags.rule()}
+	}
+	return []string{mention + " " + s.triggerTags.rule()}
+}
+
+// syncRules makes the rules stored by Twitter match the configured rules,
+// adding the missing ones and deleting the ones that are no longer wanted.
+func (vs *v2Stream) syncRules() error {
+	resp, err := vs.do("GET", v2RulesUrl, nil)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Could not get stream rules: %s: %s", resp.Status, b)
+	}
+
+	existing := struct {
+		Data []v2Rule `json:"data"`
+	}{}
+	if err = json.Unmarshal(b, &existing); err != nil {
+		return err
+	}
+
+	wanted := make(map[string]bool)
+	for _, r := range vs.rules() {
+		wanted[r] = true
+	}
+
+	stale := []string{}
+	for _, r := range existing.Data {
+		if wanted[r.Value] {
+			delete(wanted, r.Value)
+		} else {
+			stale = append(stale, r.Id)
+		}
+	}
+
+	if len(stale) > 0 {
+		req := map[string]interface{}{
+			"delete": map[string][]string{"ids": stale},
+		}
+		if err := vs.postRules(req); err != nil {
+			return err
+		}
+		log.Printf("Info: Deleted %d stale stream rules\n", len(stale))
+	}
+
+	if len(wanted) > 0 {
+		add := []v2Rule{}
+		for value := range wanted {
+			add = append(add, v2Rule{Value: value})
+		}
+		if err := vs.postRules(map[string]interface{}{"add": add}); err != nil {
+			return err
+		}
+		log.Printf("Info: Added %d stream rules\n", len(add))
+	}
+	return nil
+}
+
+func (vs *v2Stream) postRules(req interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	resp, err := vs.do("POST", v2RulesUrl, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("Could not update stream rules: %s: %s", resp.Status, b)
+	}
+
+	result := struct {
+		Errors []v2Error `json:"errors"`
+	}{}
+	if err = json.Unmarshal(b, &result); err != nil {
+		return err
+	}
+	if len(result.Errors) > 0 {
+		e := result.Errors[0]
+		return fmt.Errorf("Could not update stream rules: %s: %s", e.Title, e.Detail)
+	}
+	return nil
+}
+
+// open makes a single request for the stream, asking for the fields needed to
+// fill in a Tweet.
+func (vs *v2Stream) open() (*http.Response, error) {
+	params := url.Values{}
+	params.Set("tweet.fields", "created_at,entities,referenced_tweets,author_id")
+	params.Set("expansions", "author_id,referenced_tweets.id")
+	params.Set("user.fields", "username,name")
+	return vs.do("GET", v2StreamUrl+"?"+params.Encode(), nil)
+}
+
+func (vs *v2Stream) connect() (io.ReadCloser, error) {
+	response, err := vs.rc.connect()
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Connected to v2 filtered stream")
+	return newWatchdogReader(response.Body, vs.s.cfg.StallTimeout), nil
+}
+
+func (vs *v2Stream) Run(out chan<- *Tweet) error {
+	s := vs.s
+	err := vs.syncRules()
+	if err != nil {
+		return err
+	}
+
+	body, err := vs.connect()
+	if err != nil {
+		return err
+	}
+	defer func() { body.Close() }()
+	s.startBackfill(out)
+
+	reader := bufio.NewReader(body)
+	for {
+		str, err := reader.ReadString('\n')
+		s.captureLine(str)
+
+		if err == nil {
+			err = v2StreamError(str)
+		}
+
+		if err != nil {
+			log.Printf("Reading from twitter threw %s\n", err)
+			body.Close()
+			newBody, err := vs.connect()
+			if err != nil {
+				return err
+			}
+			body = newBody
+			reader = bufio.NewReader(body)
+			s.startBackfill(out)
+			continue
+		}
+
+		// Keep-alives carry no tweet.
+		tweet, err := decodeV2Payload(str)
+		if err != nil {
+			continue
+		}
+		out <- tweet
+	}
+}
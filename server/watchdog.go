@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// errStalled is returned by reads on a stream the watchdog gave up on.
+var errStalled = errors.New("stream stalled")
+
+// watchdogReader wraps the body of a stream and closes it once no bytes,
+// including keep-alive newlines, have arrived for timeout. The blocked read
+// then fails with errStalled and the stream goes through its reconnect path
+// instead of waiting on a dead connection forever.
+type watchdogReader struct {
+	rc      io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	stalled int32
+}
+
+func newWatchdogReader(rc io.ReadCloser, timeout time.Duration) *watchdogReader {
+	w := &watchdogReader{
+		rc:      rc,
+		timeout: timeout,
+	}
+	w.timer = time.AfterFunc(timeout, w.stall)
+	return w
+}
+
+func (w *watchdogReader) stall() {
+	atomic.StoreInt32(&w.stalled, 1)
+	stats.Add(statStalls, 1)
+	log.Printf("Failed: Nothing read from stream for %s. Dropping it\n", w.timeout)
+	w.rc.Close()
+}
+
+func (w *watchdogReader) Read(p []byte) (int, error) {
+	n, err := w.rc.Read(p)
+	if n > 0 {
+		w.timer.Reset(w.timeout)
+	}
+	if err != nil && atomic.LoadInt32(&w.stalled) == 1 {
+		err = errStalled
+	}
+	return n, err
+}
+
+func (w *watchdogReader) Close() error {
+	w.timer.Stop()
+	return w.rc.Close()
+}
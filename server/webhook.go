@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+)
+
+// maxWebhookBody bounds the size of the events Twitter may post to us.
+const maxWebhookBody = 1 << 20
+
+// webhookSource is a TweetSource that receives tweets pushed to it by
+// Twitter's Account Activity API instead of reading an outbound stream. It
+// answers the CRC challenges Twitter uses to check that the webhook is ours
+// and verifies the signature on every event it is sent.
+type webhookSource struct {
+	s    *server
+	addr string
+	path string
+}
+
+func newWebhookSource(s *server) *webhookSource {
+	return &webhookSource{
+		s:    s,
+		addr: s.cfg.WebhookListen,
+		path: s.cfg.WebhookPath,
+	}
+}
+
+// accountActivity is the body of an event posted to the webhook. Only tweet
+// creation events are of interest to the bot.
+type accountActivity struct {
+	ForUserId         string   `json:"for_user_id"`
+	TweetCreateEvents []*Tweet `json:"tweet_create_events"`
+}
+
+func (ws *webhookSource) Run(out chan<- *Tweet) error {
+	mux := http.NewServeMux()
+	mux.Handle(ws.path, ws.handler(out))
+
+	log.Printf("Listening for account activity on %s%s\n", ws.addr, ws.path)
+	return http.ListenAndServe(ws.addr, mux)
+}
+
+// handler answers CRC challenges and pushes the tweets in posted events into
+// out.
+func (ws *webhookSource) handler(out chan<- *Tweet) http.Handler {
+	secret := ws.s.cfg.ConsumerSecret
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			token := r.URL.Query().Get("crc_token")
+			if token == "" {
+				http.Error(w, "missing crc_token", http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{
+				"response_token": "sha256=" + webhookSignature(secret, []byte(token)),
+			})
+
+		case "POST":
+			b, err := ioutil.ReadAll(io.LimitReader(r.Body, maxWebhookBody))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			sig := r.Header.Get("X-Twitter-Webhooks-Signature")
+			want := "sha256=" + webhookSignature(secret, b)
+			if !hmac.Equal([]byte(sig), []byte(want)) {
+				log.Printf("Failed: webhook event from %s with a bad signature\n", r.RemoteAddr)
+				http.Error(w, "bad signature", http.StatusUnauthorized)
+				return
+			}
+
+			event := &accountActivity{}
+			if err = json.Unmarshal(b, event); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			for _, tweet := range event.TweetCreateEvents {
+				out <- tweet
+			}
+			w.WriteHeader(http.StatusOK)
+
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// webhookSignature is the base64 encoded HMAC-SHA256 of msg keyed with the
+// consumer secret, as used for both CRC responses and event signatures.
+func webhookSignature(secret string, msg []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(msg)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
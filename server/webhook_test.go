@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testConsumerSecret = "consumer-secret"
+
+// newTestWebhook serves a webhook source's handler, pushing the tweets it
+// receives into the returned channel.
+func newTestWebhook(t *testing.T) (*httptest.Server, chan *Tweet) {
+	s := &server{cfg: &config{ConsumerSecret: testConsumerSecret}}
+	ws := &webhookSource{s: s, path: "/webhook"}
+
+	out := make(chan *Tweet, 8)
+	ts := httptest.NewServer(ws.handler(out))
+	t.Cleanup(ts.Close)
+	return ts, out
+}
+
+// sign is what Twitter puts in X-Twitter-Webhooks-Signature for body.
+func sign(body string) string {
+	mac := hmac.New(sha256.New, []byte(testConsumerSecret))
+	mac.Write([]byte(body))
+	return "sha256=" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func postEvent(t *testing.T, url, body, signature string) *http.Response {
+	req, err := http.NewRequest("POST", url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Twitter-Webhooks-Signature", signature)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestWebhookAnswersCRC(t *testing.T) {
+	ts, _ := newTestWebhook(t)
+
+	resp, err := http.Get(ts.URL + "/webhook?crc_token=challenge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CRC got status %d, want 200", resp.StatusCode)
+	}
+
+	answer := map[string]string{}
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		t.Fatal(err)
+	}
+	if want := sign("challenge"); answer["response_token"] != want {
+		t.Fatalf("response_token is %q, want %q", answer["response_token"], want)
+	}
+
+	resp, err = http.Get(ts.URL + "/webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("CRC without a token got status %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestWebhookRejectsBadSignature(t *testing.T) {
+	ts, out := newTestWebhook(t)
+	body := `{"for_user_id":"1","tweet_create_events":[{"id_str":"900","id":900}]}`
+
+	for _, signature := range []string{"", "sha256=bm90IHRoZSBzaWduYXR1cmU=", sign(body + " ")} {
+		resp := postEvent(t, ts.URL+"/webhook", body, signature)
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("signature %q got status %d, want 401", signature, resp.StatusCode)
+		}
+	}
+	if len(out) != 0 {
+		t.Fatalf("%d tweets delivered from badly signed events", len(out))
+	}
+}
+
+func TestWebhookDeliversTweetCreateEvents(t *testing.T) {
+	ts, out := newTestWebhook(t)
+	body := `{"for_user_id":"1","tweet_create_events":[` +
+		`{"id_str":"900","id":900,"user":{"screen_name":"alice"}},` +
+		`{"id_str":"901","id":901,"user":{"screen_name":"bob"}}]}`
+
+	resp := postEvent(t, ts.URL+"/webhook", body, sign(body))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("event got status %d, want 200", resp.StatusCode)
+	}
+
+	if len(out) != 2 {
+		t.Fatalf("%d tweets delivered, want 2", len(out))
+	}
+	for _, want := range []string{"900", "901"} {
+		if got := (<-out).IdString(); got != want {
+			t.Fatalf("delivered tweet %s, want %s", got, want)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// The ways a full queue can make room for a new job.
+const (
+	overflowDropNewest = "dropnewest" // The new job is turned away.
+	overflowDropOldest = "dropoldest" // The job that waited longest is turned away.
+	overflowSpill      = "spill"      // The new job waits on disk instead.
+)
+
+// workQueue hands accepted jobs to a pool of workers. Jobs with the same key
+// run one after another in the order they were submitted, so that several
+// requests for the same tweet do not race each other to publish it. Jobs with
+// different keys run concurrently.
+//
+// At most size jobs wait in the queue. What happens to jobs beyond that is up
+// to the overflow policy.
+type workQueue struct {
+	size   int
+	policy string
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// Jobs whose key is free to run, oldest first.
+	ready []*job
+	// The keys of jobs that are ready or being run, each with the jobs
+	// waiting behind it.
+	waiting map[string][]*job
+	// The number of jobs in ready and waiting.
+	depth int
+	// The number of jobs spilled to disk, in total and for each key.
+	spilled     int
+	spilledKeys map[string]int
+	closed      bool
+}
+
+func newWorkQueue(size int, policy string) *workQueue {
+	q := &workQueue{
+		size:        size,
+		policy:      policy,
+		waiting:     make(map[string][]*job),
+		spilledKeys: make(map[string]int),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// submit queues j. If the queue is full the job that has to make room for it
+// is returned instead, which is j itself unless the oldest job is dropped.
+func (q *workQueue) submit(j *job) *job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var dropped *job
+	if q.depth >= q.size {
+		if q.policy != overflowDropOldest || len(q.ready) == 0 {
+			return j
+		}
+		dropped = q.ready[0]
+		q.ready = q.ready[1:]
+		q.depth--
+		// The job waiting behind the dropped one takes its place.
+		if next := q.release(dropped); next != nil {
+			q.ready = append([]*job{next}, q.ready...)
+			q.depth++
+		}
+	}
+
+	key := j.key()
+	if pending, busy := q.waiting[key]; busy {
+		q.waiting[key] = append(pending, j)
+	} else {
+		q.waiting[key] = nil
+		q.ready = append(q.ready, j)
+		q.cond.Signal()
+	}
+	q.depth++
+	return dropped
+}
+
+// take blocks until a job is ready to run and returns it. It returns nil once
+// the queue is closed and empty.
+func (q *workQueue) take() *job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.ready) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.ready) == 0 {
+		return nil
+	}
+	j := q.ready[0]
+	q.ready = q.ready[1:]
+	q.depth--
+	return j
+}
+
+// next returns the job waiting behind j, or nil if there is none and the key
+// of j is free again.
+func (q *workQueue) next(j *job) *job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.release(j)
+}
+
+func (q *workQueue) release(j *job) *job {
+	key := j.key()
+	pending := q.waiting[key]
+	if len(pending) == 0 {
+		delete(q.waiting, key)
+		return nil
+	}
+	q.waiting[key] = pending[1:]
+	q.depth--
+	return pending[0]
+}
+
+// close lets the workers stop once the jobs left in the queue have run.
+func (q *workQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+}
+
+// room returns how many more jobs fit in the queue.
+func (q *workQueue) room() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size - q.depth
+}
+
+// len returns the number of jobs waiting in memory.
+func (q *workQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.depth
+}
+
+// addSpilled counts jobs with key being moved to or from disk.
+func (q *workQueue) addSpilled(key string, n int) {
+	q.mu.Lock()
+	q.spilled += n
+	q.spilledKeys[key] += n
+	if q.spilledKeys[key] <= 0 {
+		delete(q.spilledKeys, key)
+	}
+	q.mu.Unlock()
+}
+
+// keySpilled reports whether a job with key is waiting on disk.
+func (q *workQueue) keySpilled(key string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.spilledKeys[key] > 0
+}
+
+func (q *workQueue) numSpilled() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.spilled
+}
+
+// enqueue submits an accepted job to the workers, applying the overflow
+// policy if the queue is full. A job whose key already has jobs spilled to
+// disk is spilled behind them, so that it does not run before them.
+func (s *server) enqueue(j *job) {
+	if s.work.policy == overflowSpill && s.work.keySpilled(j.key()) {
+		s.spill(j)
+		return
+	}
+
+	dropped := s.work.submit(j)
+	if dropped == nil {
+		return
+	}
+
+	if dropped == j && s.work.policy == overflowSpill {
+		s.spill(j)
+		return
+	}
+	s.dropJob(dropped)
+}
+
+// spill moves j to disk until there is room for it in the queue.
+func (s *server) spill(j *job) {
+	if err := s.store.spillJob(j); err != nil {
+		log.Printf("Failed: spilling job for tweet %s: %s\n", j.id(), err)
+		s.dropJob(j)
+		return
+	}
+	s.work.addSpilled(j.key(), 1)
+	log.Printf("Info: Spilled job for tweet %s to disk\n", j.id())
+}
+
+// dropJob gives up on a job the bot is too busy for. The requester is told to
+// try again later by the outbox, so dropping never waits on Twitter.
+func (s *server) dropJob(j *job) {
+	log.Printf("Info: Queue is full, dropping job for tweet %s\n", j.id())
+	stats.Add(statDropped, 1)
+
+	j.State = jobFailed
+	if err := s.store.putJob(j); err != nil {
+		log.Printf("Failed: storing job for tweet %s: %s\n", j.id(), err)
+	}
+	if s.cfg.BusyBudget > 0 && !s.outbox.addNotice(j.Request) {
+		log.Printf("Info: Too many notices queued to tell @%s we are too busy\n", j.Request.User.ScreenName)
+	}
+}
+
+// unspill moves as many spilled jobs back into the queue as fit.
+func (s *server) unspill() {
+	s.spillMu.Lock()
+	defer s.spillMu.Unlock()
+
+	room := s.work.room()
+	if room <= 0 || s.work.numSpilled() == 0 {
+		return
+	}
+
+	jobs, err := s.store.unspillJobs(room)
+	if err != nil {
+		log.Printf("Failed: loading spilled jobs: %s\n", err)
+		return
+	}
+	// The jobs are taken off disk in the order they were made. Every one
+	// of them is uncounted first so that none is spilled again behind the
+	// others for the same key.
+	for _, j := range jobs {
+		s.work.addSpilled(j.key(), -1)
+	}
+	for _, j := range jobs {
+		s.enqueue(j)
+	}
+}
+
+// startWorkers runs n workers that take jobs off the queue until it is
+// closed. The returned WaitGroup is done once every worker has stopped.
+func (s *server) startWorkers(n int) *sync.WaitGroup {
+	log.Printf("Info: Starting %d workers\n", n)
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := s.work.take(); j != nil; j = s.work.take() {
+				for ; j != nil; j = s.work.next(j) {
+					s.runJob(j)
+				}
+				s.unspill()
+			}
+		}()
+	}
+	return wg
+}